@@ -1,154 +1,331 @@
 package common
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/BurntSushi/toml"
-	"github.com/go-gomail/gomail"
-	"github.com/streadway/amqp"
+	"sync"
+	"time"
 )
 
 type Alert struct {
-	Host      string `json:"host"`       // 邮箱host
-	Port      int    `json:"port"`       // 邮箱端口
-	FromEmail string `json:"from_email"` // 发送邮件邮箱
-	Password  string `json:"password"`   // 密码 or 授权码
-	ToEmail   string `json:"to_email"`   // 接受邮件邮箱
+	DedupWindow     int64              `toml:"dedup_window"`     // 同一个任务同一类告警的去重窗口 秒 为0不去重
+	RecoverNotify   bool               `toml:"recover_notify"`   // 失败的任务再次成功时是否发送恢复通知
+	Channels        []*AlertChannelCfg `toml:"channel"`          // 告警渠道 可以同时配置多个
+	Routes          []*AlertRoute      `toml:"route"`            // 按任务标签路由的规则 按顺序匹配
+	DefaultChannels []string           `toml:"default_channels"` // 没有匹配的路由规则时使用的渠道 为空表示所有渠道
+	notifiers       []AlertNotifier
+
+	stop     chan struct{} // 失去leader时关闭 停止接收告警
+	done     chan struct{} // 告警协程退出后关闭
+	stopOnce sync.Once
 }
 
 type AlertsInfo struct {
-	Worker    string // 产生告警信息的worker节点
-	AlertType int64  // 告警的类型 1 超时  2 执行出错
-	ErrorInfo string // 错误信息
-	Time      string // 告警发生时间
+	ID         string            // 告警id 由产生告警的节点生成 重新投递时不变
+	JobName    string            // 产生告警的任务 为空时不去重
+	Labels     map[string]string // 任务的标签 用于路由
+	Channels   []string          // 任务指定的告警渠道
+	Recipients []string          // 任务指定的额外邮件收件人
+	Worker     string            // 产生告警信息的worker节点
+	AlertType  int64             // 告警的类型 1 超时  2 执行出错  3 任务被强制杀死  4 任务恢复  5 执行时间过长  6 错过执行
+	ErrorInfo  string            // 错误信息
+	Time       string            // 告警发生时间
+	Suppressed int64             // 上一个去重窗口内被抑制的告警数
+	Digest     bool              // 是否为去重窗口结束时的汇总告警
 }
 
-// 如果该节点不再是leader 那么就取消他的告警功能
-var LoseLeader chan struct{}
-var GM *gomail.Message
+// 当前生效的告警配置
+var Alerter *Alert
+
+// 配置的告警渠道名  保存任务时检查任务指定的渠道  没有读取配置时不检查
+var alertChannels map[string]bool
 
-func loadEmailCfg(path string) (*Alert, error) {
-	cfg := &Alert{}
+func loadAlertCfg(path string) (*Alert, error) {
+	cfg := &Alert{stop: make(chan struct{}), done: make(chan struct{})}
 	if _, err := toml.DecodeFile(path, cfg); err != nil {
 		return cfg, err
 	}
 
+	// 没有配置告警渠道时输出到标准输出
+	if len(cfg.Channels) == 0 {
+		cfg.Channels = append(cfg.Channels, &AlertChannelCfg{Type: ALERT_CHANNEL_CONSOLE})
+	}
+	for _, channel := range cfg.Channels {
+		notifier, err := NewAlertNotifier(channel)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.notifiers = append(cfg.notifiers, notifier)
+	}
+
+	// 路由规则只能使用配置过的渠道
+	names := make(map[string]bool)
+	for _, channel := range cfg.Channels {
+		names[channel.Name] = true
+	}
+	check := append([]string{}, cfg.DefaultChannels...)
+	for _, route := range cfg.Routes {
+		check = append(check, route.Channels...)
+	}
+	for _, name := range check {
+		if !names[name] {
+			return cfg, fmt.Errorf("告警路由使用了不存在的渠道 : %s", name)
+		}
+	}
 	return cfg, nil
 }
 
-func InitAlert(path string) error {
-	cfg, err := loadEmailCfg(path)
+// 读取配置中的告警渠道名  所有master都需要 只有leader会初始化告警
+func InitAlertChannels(path string) error {
+	cfg, err := loadAlertCfg(path)
 	if err != nil {
 		return err
 	}
 
-	GM = gomail.NewMessage()
-	GM.SetHeader("To", cfg.ToEmail)
-	GM.SetAddressHeader("From", cfg.FromEmail, "")
-
-	go cfg.alertLoop()
-
+	alertChannels = make(map[string]bool)
+	for _, channel := range cfg.Channels {
+		alertChannels[channel.Name] = true
+	}
 	return nil
 }
 
-func (a *Alert) alertLoop() error {
-	conn, err := amqp.Dial(mqcfg.Url)
-	defer conn.Close()
-	if err != nil {
-		return err
-	}
+// 告警渠道是否存在
+func AlertChannelExists(name string) bool {
+	return alertChannels == nil || alertChannels[name]
+}
 
-	// 创建channel
-	ch, err := conn.Channel()
-	defer ch.Close()
+func InitAlert(path string) error {
+	cfg, err := loadAlertCfg(path)
 	if err != nil {
 		return err
 	}
 
-	queue, err := ch.QueueDeclare(mqcfg.Queue, false, false, false, false, nil)
-	if err != nil {
-		return err
-	}
+	// 重新选举为leader时 先停止之前的告警协程
+	StopAlerts()
+	Alerter = cfg
+	go cfg.alertLoop()
 
-	// 消费数据
-	msgs, err := ch.Consume(queue.Name, "", true, false, false, false, nil)
-	if err != nil {
-		return err
+	return nil
+}
+
+func (a *Alert) alertLoop() {
+	defer close(a.done)
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+
+	// 定时发送去重窗口内被抑制告警的汇总
+	ticker := time.NewTicker(ALERT_DIGEST_INTERVAL * time.Second)
+	defer ticker.Stop()
+
+	// 正在发送的告警
+	var sending sync.WaitGroup
+
+	// 订阅告警  告警发送成功后才确认 没有确认的告警在leader切换后由新的leader处理
+	// 订阅出错或者连接断开时 只要还是leader就按退避时间重新订阅
+	var msgs <-chan *Event
+	subscribe := time.NewTimer(0)
+	defer subscribe.Stop()
+	backoff := time.Second
+	retry := func(reason string, err error) {
+		fmt.Println(reason, backoff, "后重新订阅 : ", err)
+		subscribe.Reset(backoff)
+		if backoff *= 2; backoff > MQ_MAX_BACKOFF*time.Second {
+			backoff = MQ_MAX_BACKOFF * time.Second
+		}
 	}
 
 	for {
 		select {
-		case <-LoseLeader: // 如果该节点不再是leader 那么就取消他的告警功能
-			goto END
-		case msg := <-msgs:
-			go func() {
-				alert := &AlertsInfo{}
-				json.Unmarshal(msg.Body, alert)
-				wrap(alert)
-				//if err := a.sendMail(alert); err !=nil {
-				//	fmt.Println("send err : ", err)
-				//	return
-				//}
-			}()
+		case <-a.stop: // 如果该节点不再是leader 那么就取消他的告警功能
+			a.handoff(&sending)
+			return
+		case <-subscribe.C:
+			var err error
+			if msgs, err = Receive(ctx); err != nil {
+				retry("订阅告警出错", err)
+			}
+		case <-ticker.C:
+			digests, err := a.digests()
+			if err != nil {
+				fmt.Println("汇总告警出错 : ", err)
+			}
+			for _, digest := range digests {
+				sending.Add(1)
+				go func(digest *AlertsInfo) {
+					defer sending.Done()
+					a.notify(digest)
+				}(digest)
+			}
+		case msg, ok := <-msgs:
+			if !ok {
+				msgs = nil
+				retry("告警订阅已断开", nil)
+				continue
+			}
+			backoff = time.Second
+
+			// 无法解析的告警不会再成功 直接放入死信队列
+			alert := &AlertsInfo{}
+			if err := json.Unmarshal(msg.Body, alert); err != nil {
+				fmt.Println("解析告警信息出错 : ", err)
+				msg.Nack(false)
+				continue
+			}
+
+			// 去重状态需要按顺序更新  发送在单独的协程中进行
+			send, err := a.dedup(alert)
+			if err != nil {
+				fmt.Println("告警去重出错 直接发送 : ", err)
+				send = alert
+			}
+			if send == nil {
+				// 被抑制的告警也保存记录
+				record := NewAlertRecord(alert)
+				record.Suppressed = true
+				saveAlertRecord(record)
+				msg.Ack()
+				continue
+			}
+
+			sending.Add(1)
+			go func(msg *Event, alert *AlertsInfo) {
+				defer sending.Done()
+				a.deliver(msg, alert)
+			}(msg, send)
 		}
-	END:
 	}
+}
 
-	return nil
+// 发送一条告警  至少一个渠道发送成功后确认  重试之后仍然失败的放入死信队列
+func (a *Alert) deliver(msg *Event, alert *AlertsInfo) {
+	for attempt := 1; ; attempt++ {
+		if a.notify(alert) {
+			msg.Ack()
+			return
+		}
+		if attempt >= ALERT_DELIVERY_RETRIES {
+			fmt.Println("告警", alert.ID, " 发送", attempt, "次都失败 放入死信队列")
+			msg.Nack(false)
+			return
+		}
+
+		// 等待期间失去leader 交给新的leader重试
+		select {
+		case <-a.stop:
+			msg.Nack(true)
+			return
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+	}
+}
+
+// 失去leader时停止接收新的告警  等待正在发送的告警完成后再取消订阅
+// 超时没有完成的告警没有确认 会重新投递给新的leader
+func (a *Alert) handoff(sending *sync.WaitGroup) {
+	finished := make(chan struct{})
+	go func() {
+		sending.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(ALERT_HANDOFF_TIMEOUT * time.Second):
+		fmt.Println("等待告警发送完成超时 没有确认的告警由新的leader处理")
+	}
 }
 
-func wrap(alert *AlertsInfo) {
-	if alert != nil {
-		fmt.Println("************************ 告警信息 ************************")
-		fmt.Println()
-		fmt.Println("告警节点 : ", alert.Worker)
-		tpe := ""
-		switch alert.AlertType {
-		case 1:
-			tpe = "超时"
-		case 2:
-			tpe = "执行出错"
-		case 3:
-			tpe = "任务被强制杀死"
+// 把告警发送到路由的告警渠道  一个渠道失败不影响其他渠道  保存每个渠道的发送结果
+// 返回是否有渠道发送成功 没有可用的渠道时视为失败
+func (a *Alert) notify(alert *AlertsInfo) bool {
+	record := NewAlertRecord(alert)
+	notifiers := a.route(alert)
+	delivered := false
+	for _, notifier := range notifiers {
+		err := notifier.Notify(alert)
+		if err != nil {
+			fmt.Println("告警渠道", notifier.Name(), " 发送告警出错 : ", err)
+		} else {
+			delivered = true
 		}
-		fmt.Println("告警类型 : ", tpe)
-		fmt.Println("告警时间 : ", alert.Time)
-		fmt.Println("告警具体信息 : ", alert.ErrorInfo)
-		fmt.Println()
-		fmt.Println("*********************************************************")
+		record.Deliver(notifier.Name(), err)
 	}
+	saveAlertRecord(record)
+	return delivered
 }
 
-// 发送告警邮件
-func (a *Alert) sendMail(alert *AlertsInfo) error {
-	var tpe string
-	switch alert.AlertType {
-	case 1:
-		tpe = "超时"
-	case 2:
-		tpe = "执行出错"
-	case 3:
-		tpe = "任务被强制杀死"
+func saveAlertRecord(record *AlertRecord) {
+	if err := SaveAlertRecord(record); err != nil {
+		fmt.Println("保存告警记录出错 : ", err)
 	}
+}
 
-	body := "<h2> 告警类型 : " + tpe + "</h2>\n"
-	body += "<p>告警节点 : " + alert.Worker + "</p>\n"
-	body += "<p>告警信息 : " + alert.ErrorInfo + "</p>\n"
+// 向所有的告警渠道发送一条测试告警  返回每个渠道的发送结果
+func (a *Alert) Test(alert *AlertsInfo) map[string]string {
+	result := make(map[string]string)
+	for _, notifier := range a.notifiers {
+		result[notifier.Name()] = "success"
+		if err := notifier.Notify(alert); err != nil {
+			result[notifier.Name()] = err.Error()
+		}
+	}
+	return result
+}
 
-	//fmt.Println("GM : ", GM)
+// 告警类型的名称
+func (a *AlertsInfo) TypeName() string {
+	switch a.AlertType {
+	case ALERT_TYPE_TIMEOUT:
+		return "超时"
+	case ALERT_TYPE_FAILED:
+		return "执行出错"
+	case ALERT_TYPE_KILLED:
+		return "任务被强制杀死"
+	case ALERT_TYPE_RECOVERED:
+		return "任务恢复"
+	case ALERT_TYPE_LONGRUNNING:
+		return "执行时间过长"
+	case ALERT_TYPE_MISSED:
+		return "错过执行"
+	}
+	return "未知"
+}
 
-	gm := GM
-	gm.SetBody("text/html", body)
-	dialer := gomail.NewDialer(a.Host, a.Port, a.FromEmail, a.Password)
+// 告警的标题 用作邮件主题
+func (a *AlertsInfo) Title() string {
+	if a.JobName != "" {
+		return fmt.Sprintf("[定时任务告警] %s %s %s", a.JobName, a.TypeName(), a.Worker)
+	}
+	return fmt.Sprintf("[定时任务告警] %s %s", a.TypeName(), a.Worker)
+}
 
-	err := dialer.DialAndSend(gm)
-	if err != nil {
-		return err
+// 告警的文本内容 用于聊天消息和标准输出
+func (a *AlertsInfo) Text() string {
+	text := fmt.Sprintf("告警任务 : %s\n告警节点 : %s\n告警类型 : %s\n告警时间 : %s\n告警具体信息 : %s",
+		a.JobName, a.Worker, a.TypeName(), a.Time, a.ErrorInfo)
+	if a.Digest {
+		return fmt.Sprintf("去重窗口内共抑制了%d条相同的告警 最后一条 :\n%s", a.Suppressed, text)
+	}
+	if a.Suppressed > 0 {
+		text += fmt.Sprintf("\n上次告警之后被抑制的告警数 : %d", a.Suppressed)
 	}
+	return text
+}
 
-	return nil
+// 停止告警  等待正在发送的告警交接完成
+func (a *Alert) Stop() {
+	a.stopOnce.Do(func() {
+		close(a.stop)
+	})
+	<-a.done
 }
 
+// 如果该节点不再是leader 那么就取消他的告警功能
 func StopAlerts() {
-	LoseLeader <- struct{}{}
+	if Alerter != nil {
+		Alerter.Stop()
+	}
 }
@@ -0,0 +1,214 @@
+package common
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// 一条告警的记录  包含每个渠道的发送结果
+type AlertRecord struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id"`
+	JobName    string             `json:"jobName" bson:"jobName"`       // 产生告警的任务
+	Worker     string             `json:"worker" bson:"worker"`         // 产生告警的worker
+	AlertType  int64              `json:"alertType" bson:"alertType"`   // 告警类型
+	TypeName   string             `json:"typeName" bson:"typeName"`     // 告警类型的名称
+	Message    string             `json:"message" bson:"message"`       // 告警信息
+	AlertTime  string             `json:"alertTime" bson:"alertTime"`   // 告警发生时间
+	Time       int64              `json:"time" bson:"time"`             // leader收到告警的时间 毫秒
+	Suppressed bool               `json:"suppressed" bson:"suppressed"` // 是否在去重窗口内被抑制 没有发送
+	Digest     bool               `json:"digest" bson:"digest"`         // 是否为汇总告警
+	Deliveries []*AlertDelivery   `json:"deliveries" bson:"deliveries"` // 每个渠道的发送结果
+	Acked      bool               `json:"acked" bson:"acked"`           // 是否已经被处理
+	AckedBy    string             `json:"ackedBy" bson:"ackedBy"`       // 处理告警的用户
+	AckedAt    int64              `json:"ackedAt" bson:"ackedAt"`       // 处理告警的时间 毫秒
+}
+
+// 告警在一个渠道的发送结果
+type AlertDelivery struct {
+	Channel string `json:"channel" bson:"channel"` // 渠道名
+	Status  string `json:"status" bson:"status"`   // success / failed
+	Error   string `json:"error" bson:"error"`     // 发送失败的原因
+}
+
+// 告警查询条件  为空的条件不参与过滤
+type AlertQuery struct {
+	JobName   string `json:"jobName"`   // 任务名
+	Worker    string `json:"worker"`    // 产生告警的worker
+	AlertType int64  `json:"alertType"` // 告警类型 0表示所有类型
+	Acked     *bool  `json:"acked"`     // 是否已经处理 为空表示全部
+	StartFrom int64  `json:"startFrom"` // 告警时间不早于 毫秒
+	StartTo   int64  `json:"startTo"`   // 告警时间早于 毫秒
+	Cursor    string `json:"cursor"`    // 上一页返回的nextCursor 为空表示第一页
+	Limit     int64  `json:"limit"`     // 每页条数
+}
+
+// 一页告警  按时间倒序
+type AlertPage struct {
+	Alerts     []*AlertRecord `json:"alerts"`
+	Total      int64          `json:"total"`      // 满足条件的告警总数
+	NextCursor string         `json:"nextCursor"` // 下一页的游标 没有下一页时为空
+}
+
+// 告警的记录使用告警的id  重新投递的告警更新同一条记录
+func NewAlertRecord(alert *AlertsInfo) *AlertRecord {
+	id, err := primitive.ObjectIDFromHex(alert.ID)
+	if err != nil {
+		id = primitive.NewObjectID()
+	}
+	return &AlertRecord{
+		ID:         id,
+		JobName:    alert.JobName,
+		Worker:     alert.Worker,
+		AlertType:  alert.AlertType,
+		TypeName:   alert.TypeName(),
+		Message:    alert.ErrorInfo,
+		AlertTime:  alert.Time,
+		Time:       time.Now().UnixNano() / 1000000,
+		Digest:     alert.Digest,
+		Deliveries: make([]*AlertDelivery, 0),
+	}
+}
+
+// 记录一个渠道的发送结果
+func (r *AlertRecord) Deliver(channel string, err error) {
+	delivery := &AlertDelivery{Channel: channel, Status: ALERT_DELIVERY_SUCCESS}
+	if err != nil {
+		delivery.Status, delivery.Error = ALERT_DELIVERY_FAILED, err.Error()
+	}
+	r.Deliveries = append(r.Deliveries, delivery)
+}
+
+// 保存告警记录  没有连接MongoDB时不保存
+func SaveAlertRecord(record *AlertRecord) error {
+	if MongoDB == nil {
+		return nil
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), LOG_WRITE_TIMEOUT*time.Second)
+	defer cancelFunc()
+	_, err := MongoDB.Alerts.ReplaceOne(ctx, bson.M{"_id": record.ID}, record, options.Replace().SetUpsert(true))
+	return err
+}
+
+// 生成mongo的过滤条件 不包含游标
+func (q *AlertQuery) Filter() bson.M {
+	filter := bson.M{}
+	if q.JobName != "" {
+		filter["jobName"] = q.JobName
+	}
+	if q.Worker != "" {
+		filter["worker"] = q.Worker
+	}
+	if q.AlertType > 0 {
+		filter["alertType"] = q.AlertType
+	}
+	if q.Acked != nil {
+		filter["acked"] = *q.Acked
+	}
+
+	t := bson.M{}
+	if q.StartFrom > 0 {
+		t["$gte"] = q.StartFrom
+	}
+	if q.StartTo > 0 {
+		t["$lt"] = q.StartTo
+	}
+	if len(t) > 0 {
+		filter["time"] = t
+	}
+	return filter
+}
+
+// 查询告警记录  id按时间递增 按id倒序分页
+func QueryAlerts(query *AlertQuery) (*AlertPage, error) {
+	page := &AlertPage{Alerts: make([]*AlertRecord, 0)}
+	if MongoDB == nil {
+		return page, ERR_ALERT_STORE_UNAVAILABLE
+	}
+
+	filter := query.Filter()
+	var err error
+	page.Total, err = MongoDB.Alerts.CountDocuments(context.TODO(), filter)
+	if err != nil {
+		return page, err
+	}
+
+	if query.Cursor != "" {
+		id, err := primitive.ObjectIDFromHex(query.Cursor)
+		if err != nil {
+			return page, ERR_INVALID_CURSOR
+		}
+		filter["_id"] = bson.M{"$lt": id}
+	}
+
+	// 多取一条 判断是否还有下一页
+	limit := query.Limit
+	if limit <= 0 {
+		limit = LOG_PAGE_SIZE
+	}
+	if limit > LOG_MAX_PAGE_SIZE {
+		limit = LOG_MAX_PAGE_SIZE
+	}
+	limit++
+	sort := bson.D{{Key: "_id", Value: -1}}
+	cursor, err := MongoDB.Alerts.Find(context.TODO(), filter, &options.FindOptions{Limit: &limit, Sort: sort})
+	if err != nil {
+		return page, err
+	}
+	defer cursor.Close(context.TODO())
+
+	if err := cursor.All(context.TODO(), &page.Alerts); err != nil {
+		return page, err
+	}
+
+	if int64(len(page.Alerts)) >= limit {
+		page.Alerts = page.Alerts[:limit-1]
+		page.NextCursor = page.Alerts[len(page.Alerts)-1].ID.Hex()
+	}
+	return page, nil
+}
+
+// 标记告警已经处理  已经处理过的告警保留第一次处理的用户和时间
+func AckAlert(id, user string) (*AlertRecord, error) {
+	if MongoDB == nil {
+		return nil, ERR_ALERT_STORE_UNAVAILABLE
+	}
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ERR_ALERT_NOT_FOUND
+	}
+
+	update := bson.M{"$set": bson.M{
+		"acked":   true,
+		"ackedBy": user,
+		"ackedAt": time.Now().UnixNano() / 1000000,
+	}}
+	record := &AlertRecord{}
+	err = MongoDB.Alerts.FindOneAndUpdate(context.TODO(), bson.M{"_id": oid, "acked": false}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(record)
+	if err == mongo.ErrNoDocuments {
+		// 告警不存在 或者已经被处理
+		if err := MongoDB.Alerts.FindOne(context.TODO(), bson.M{"_id": oid}).Decode(record); err != nil {
+			return nil, ERR_ALERT_NOT_FOUND
+		}
+		return record, nil
+	}
+	return record, err
+}
+
+// 创建告警查询需要的索引
+func (m *Mongo) CreateAlertIndexes() error {
+	models := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "jobName", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "acked", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "time", Value: -1}}},
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFunc()
+	_, err := m.Alerts.Indexes().CreateMany(ctx, models)
+	return err
+}
@@ -0,0 +1,154 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// 任务的告警配置
+type AlertPolicy struct {
+	Events      []string `json:"events"`       // 需要告警的事件 failed timeout killed long_running missed 为空时告警failed timeout killed
+	LongRunning int64    `json:"long_running"` // 执行超过多少秒发送long_running告警 0表示不检查
+	Channels    []string `json:"channels"`     // 发送的告警渠道名 为空时按master的路由规则
+	Recipients  []string `json:"recipients"`   // 额外的邮件收件人
+}
+
+// 告警路由规则  标签匹配的任务发送到指定的渠道
+type AlertRoute struct {
+	Match    map[string]string `toml:"match"`    // 任务标签 全部匹配才生效
+	Channels []string          `toml:"channels"` // 告警渠道名
+	Continue bool              `toml:"continue"` // 匹配后是否继续匹配后面的规则
+}
+
+// 告警类型对应的事件名
+var alertEvents = map[int64]string{
+	ALERT_TYPE_TIMEOUT:     ALERT_EVENT_TIMEOUT,
+	ALERT_TYPE_FAILED:      ALERT_EVENT_FAILED,
+	ALERT_TYPE_KILLED:      ALERT_EVENT_KILLED,
+	ALERT_TYPE_LONGRUNNING: ALERT_EVENT_LONGRUNNING,
+	ALERT_TYPE_MISSED:      ALERT_EVENT_MISSED,
+}
+
+// 是否是支持的告警事件
+func ValidAlertEvent(event string) bool {
+	for _, e := range alertEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// 任务是否需要发送该类告警  任务恢复在失败或者超时需要告警时发送
+func (p *AlertPolicy) Enabled(alertType int64) bool {
+	events := []string{ALERT_EVENT_FAILED, ALERT_EVENT_TIMEOUT, ALERT_EVENT_KILLED}
+	if p != nil && len(p.Events) > 0 {
+		events = p.Events
+	}
+
+	for _, event := range events {
+		if event == alertEvents[alertType] {
+			return true
+		}
+		if alertType == ALERT_TYPE_RECOVERED && (event == ALERT_EVENT_FAILED || event == ALERT_EVENT_TIMEOUT) {
+			return true
+		}
+	}
+	return false
+}
+
+// 按任务的告警配置生成告警  任务没有开启该类告警时返回nil
+func NewJobAlert(jobName string, labels map[string]string, policy *AlertPolicy, alertType int64, errorInfo string) *AlertsInfo {
+	if !policy.Enabled(alertType) {
+		return nil
+	}
+
+	ip, _ := GetLocalIP()
+	alert := &AlertsInfo{
+		ID:        primitive.NewObjectID().Hex(),
+		JobName:   jobName,
+		Labels:    labels,
+		Worker:    ip,
+		AlertType: alertType,
+		ErrorInfo: errorInfo,
+		Time:      time.Now().Format(TIME_FORMAT),
+	}
+	if policy != nil {
+		alert.Channels = policy.Channels
+		alert.Recipients = policy.Recipients
+	}
+	return alert
+}
+
+// 把告警放入发送队列 由后台协程发送到mq 再由leader处理  不会阻塞调用方
+func SendAlert(alert *AlertsInfo) error {
+	if alert == nil {
+		return nil
+	}
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	return Send(body)
+}
+
+// 选择告警发送的渠道  任务指定了渠道时直接使用 否则按路由规则 没有匹配的规则时使用默认渠道
+func (a *Alert) route(alert *AlertsInfo) []AlertNotifier {
+	names := alert.Channels
+	if len(names) == 0 {
+		for _, route := range a.Routes {
+			if !labelsMatch(alert.Labels, route.Match) {
+				continue
+			}
+			names = append(names, route.Channels...)
+			if !route.Continue {
+				break
+			}
+		}
+	}
+	if len(names) == 0 {
+		names = a.DefaultChannels
+	}
+
+	// 任务指定的渠道都不存在时使用默认渠道 避免告警没有发送就被确认
+	notifiers := a.channels(names)
+	if len(notifiers) == 0 && len(names) > 0 {
+		fmt.Println("告警", alert.ID, " 指定的渠道", names, " 不存在 使用默认渠道")
+		notifiers = a.channels(a.DefaultChannels)
+	}
+	return notifiers
+}
+
+// 按渠道名返回告警渠道  没有指定渠道名时返回所有渠道
+func (a *Alert) channels(names []string) []AlertNotifier {
+	if len(names) == 0 {
+		return a.notifiers
+	}
+
+	var notifiers []AlertNotifier
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		for _, notifier := range a.notifiers {
+			if notifier.Name() == name {
+				notifiers = append(notifiers, notifier)
+			}
+		}
+	}
+	return notifiers
+}
+
+// 标签是否满足匹配条件 没有条件时匹配所有
+func labelsMatch(labels, match map[string]string) bool {
+	for k, v := range match {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+package common
+
+import "testing"
+
+func testRouter() *Alert {
+	return &Alert{
+		Routes: []*AlertRoute{
+			{Match: map[string]string{"team": "billing"}, Channels: []string{"billing"}},
+		},
+		DefaultChannels: []string{"ops"},
+		notifiers: []AlertNotifier{
+			&ConsoleNotifier{name: "ops"},
+			&ConsoleNotifier{name: "billing"},
+			&ConsoleNotifier{name: "dba"},
+		},
+	}
+}
+
+func routeNames(notifiers []AlertNotifier) []string {
+	var names []string
+	for _, notifier := range notifiers {
+		names = append(names, notifier.Name())
+	}
+	return names
+}
+
+func TestAlertRoute(t *testing.T) {
+	cases := []struct {
+		name  string
+		alert *AlertsInfo
+		want  string
+	}{
+		{"任务指定渠道", &AlertsInfo{Channels: []string{"dba", "dba"}, Labels: map[string]string{"team": "billing"}}, "dba"},
+		{"按标签路由", &AlertsInfo{Labels: map[string]string{"team": "billing"}}, "billing"},
+		{"没有匹配的规则", &AlertsInfo{Labels: map[string]string{"team": "search"}}, "ops"},
+		{"指定的渠道不存在", &AlertsInfo{Channels: []string{"typo"}}, "ops"},
+	}
+
+	router := testRouter()
+	for _, c := range cases {
+		names := routeNames(router.route(c.alert))
+		if len(names) != 1 || names[0] != c.want {
+			t.Errorf("%s : 发送到 %v 期望 %s", c.name, names, c.want)
+		}
+	}
+}
+
+// 没有默认渠道时 指定的渠道不存在就发送到所有渠道
+func TestAlertRouteUnknownWithoutDefault(t *testing.T) {
+	router := testRouter()
+	router.DefaultChannels = nil
+	if names := routeNames(router.route(&AlertsInfo{Channels: []string{"typo"}})); len(names) != 3 {
+		t.Fatalf("发送到 %v 期望所有渠道", names)
+	}
+}
@@ -0,0 +1,159 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/coreos/etcd/clientv3"
+	"time"
+)
+
+// 同一个任务同一类告警的发送状态  保存在etcd中 leader切换后继续生效
+type AlertState struct {
+	LastSent   int64       `json:"last_sent"`  // 最后一次发送告警的时间 秒
+	SentID     string      `json:"sent_id"`    // 最后一次发送的告警id
+	Suppressed int64       `json:"suppressed"` // 最后一次发送之后被抑制的告警数
+	Last       *AlertsInfo `json:"last"`       // 最后一条告警
+}
+
+func alertStateKey(jobName string, alertType int64) string {
+	return fmt.Sprintf("%s%s/%d", ALERT_STATE_DIR, jobName, alertType)
+}
+
+// 任务是否处于失败状态  失败的任务再次成功时需要发送恢复通知
+func JobFailing(jobName string) (bool, error) {
+	getResp, err := ETCD.KV.Get(context.TODO(), ALERT_FAILING_DIR+jobName, clientv3.WithCountOnly())
+	if err != nil {
+		return false, err
+	}
+	return getResp.Count > 0, nil
+}
+
+// 处理一条告警  在去重窗口内重复的告警只计数不发送  返回需要发送的告警 不需要发送时返回nil
+func (a *Alert) dedup(alert *AlertsInfo) (*AlertsInfo, error) {
+	if alert.JobName == "" {
+		return alert, nil
+	}
+
+	// 任务恢复 清除失败状态和所有类型的去重状态
+	if alert.AlertType == ALERT_TYPE_RECOVERED {
+		delResp, err := ETCD.KV.Delete(context.TODO(), ALERT_FAILING_DIR+alert.JobName)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := ETCD.KV.Delete(context.TODO(), ALERT_STATE_DIR+alert.JobName+"/", clientv3.WithPrefix()); err != nil {
+			return nil, err
+		}
+		// 其他master已经处理过 或者失败状态已经被清除
+		if delResp.Deleted == 0 || !a.RecoverNotify {
+			return nil, nil
+		}
+		return alert, nil
+	}
+
+	if alert.AlertType == ALERT_TYPE_FAILED || alert.AlertType == ALERT_TYPE_TIMEOUT {
+		if _, err := ETCD.KV.Put(context.TODO(), ALERT_FAILING_DIR+alert.JobName, alert.Time); err != nil {
+			return nil, err
+		}
+	}
+
+	if a.DedupWindow <= 0 {
+		return alert, nil
+	}
+
+	key := alertStateKey(alert.JobName, alert.AlertType)
+	state := &AlertState{}
+	getResp, err := ETCD.KV.Get(context.TODO(), key)
+	if err != nil {
+		return nil, err
+	}
+	if len(getResp.Kvs) > 0 {
+		json.Unmarshal(getResp.Kvs[0].Value, state)
+	}
+
+	// 同一条告警被重新投递 说明上次发送没有完成 按上次的结果处理
+	if alert.ID != "" && state.Last != nil && state.Last.ID == alert.ID {
+		if state.SentID == alert.ID {
+			return alert, nil
+		}
+		return nil, nil
+	}
+
+	now := time.Now().Unix()
+	send := now-state.LastSent >= a.DedupWindow
+	if send {
+		// 带上上一个窗口内被抑制的数量
+		alert.Suppressed = state.Suppressed
+		state.LastSent, state.SentID, state.Suppressed = now, alert.ID, 0
+	} else {
+		state.Suppressed++
+	}
+	state.Last = alert
+
+	if err := putAlertState(key, state); err != nil {
+		return nil, err
+	}
+	if !send {
+		return nil, nil
+	}
+	return alert, nil
+}
+
+func putAlertState(key string, state *AlertState) error {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	_, err = ETCD.KV.Put(context.TODO(), key, string(value))
+	return err
+}
+
+// 去重窗口结束时 把窗口内被抑制的告警汇总发送一次  返回需要发送的汇总告警
+func (a *Alert) digests() ([]*AlertsInfo, error) {
+	if a.DedupWindow <= 0 {
+		return nil, nil
+	}
+
+	getResp, err := ETCD.KV.Get(context.TODO(), ALERT_STATE_DIR, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	var alerts []*AlertsInfo
+	for _, kv := range getResp.Kvs {
+		state := &AlertState{}
+		if err := json.Unmarshal(kv.Value, state); err != nil || state.Last == nil {
+			continue
+		}
+		if now-state.LastSent < a.DedupWindow {
+			continue
+		}
+
+		// 窗口内没有新的告警 清除状态  读取之后状态被更新过就不删除
+		if state.Suppressed == 0 {
+			key := string(kv.Key)
+			_, err := ETCD.KV.Txn(context.TODO()).
+				If(clientv3.Compare(clientv3.ModRevision(key), "=", kv.ModRevision)).
+				Then(clientv3.OpDelete(key)).Commit()
+			if err != nil {
+				return alerts, err
+			}
+			continue
+		}
+
+		// 汇总告警使用新的id
+		digest := *state.Last
+		digest.ID = ""
+		digest.Suppressed = state.Suppressed
+		digest.Digest = true
+		digest.Time = time.Now().Format(TIME_FORMAT)
+		alerts = append(alerts, &digest)
+
+		state.LastSent, state.Suppressed = now, 0
+		if err := putAlertState(string(kv.Key), state); err != nil {
+			return alerts, err
+		}
+	}
+	return alerts, nil
+}
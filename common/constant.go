@@ -1,17 +1,209 @@
 package common
 
 const (
-	MASTER_LOCK_DIR = "/init/master/"
+	// 所有master竞选同一个key
+	MASTER_ELECTION_KEY = "/cron/election/master"
+	// leader租约的过期时间 秒
+	MASTER_LEASE_TTL = 5
+	// 选举出错后重试的最大退避时间 秒
+	MASTER_MAX_BACKOFF = 30
+
 	JOB_LOCK_KEY = "/cron/lock/"
 
+	// 信号量的定义 持有的名额 以及等待者
+	SEMAPHORE_SAVE_DIR = "/cron/semaphore/def/"
+	SEMAPHORE_SLOT_DIR = "/cron/semaphore/slot/"
+	SEMAPHORE_WAIT_DIR = "/cron/semaphore/wait/"
+	// 任务没有配置时等待信号量的最长时间 秒
+	SEMAPHORE_MAX_WAIT = 300
+
+	// 任务锁租约的过期时间 秒
+	JOB_LOCK_TTL = 5
+	// 允许并发执行时 每次触发对应的锁保留的时间 秒  要大于各个worker收到同一次触发的时间差
+	JOB_TICK_TTL = 60
+	// 传给任务进程的fencing token环境变量
+	JOB_FENCING_ENV = "CRON_FENCING_TOKEN"
+	// 执行期间任务锁丢失的处理策略  kill 杀死任务  mark 继续执行 结束原因记为lock_lost
+	LOCK_LOST_KILL = "kill"
+	LOCK_LOST_MARK = "mark"
+
 	JOB_WORKER_DIR = "/cron/workers/"
 	JOB_SAVE_DIR   = "/cron/jobs/"
 	JOB_DELETE_DIR = "/cron/delete/"
 	JOB_KILL_DIR   = "/cron/kill/"
+	JOB_RUN_DIR    = "/cron/run/"
+	JOB_ASSIGN_DIR = "/cron/assign/"
+	JOB_OUTPUT_DIR = "/cron/output/"
+	JOB_LAST_DIR   = "/cron/last/"
+
+	WORKFLOW_SAVE_DIR = "/cron/workflows/"
+	WORKFLOW_RUN_DIR  = "/cron/workflow/runs/"
+	WORKFLOW_DONE_DIR = "/cron/workflow/done/"
 
 	JOB_EVENT_SAVE   = 1
 	JOB_EVENT_DELETE = 2
 	JOB_EVENT_KILL   = 3
+	JOB_EVENT_RUN    = 4
+	JOB_EVENT_ASSIGN = 5
+
+	JOB_TRIGGER_CRON     = "cron"
+	JOB_TRIGGER_MANUAL   = "manual"
+	JOB_TRIGGER_WORKFLOW = "workflow"
+	JOB_TRIGGER_MISFIRE  = "misfire"
+
+	MISFIRE_SKIP     = "skip"
+	MISFIRE_RUN_ONCE = "run_once"
+	MISFIRE_RUN_ALL  = "run_all"
+
+	// 超过计划时间多久还没有被调度 认为错过了执行 秒
+	MISFIRE_GRACE = 30
+	// run_all策略默认最多补执行的次数
+	MISFIRE_LIMIT = 10
+	// 每次检查最多处理的错过次数
+	MISFIRE_MAX_SCAN = 1000
+
+	// 预览执行时间时默认和最多返回的次数
+	PREVIEW_DEFAULT_COUNT = 5
+	PREVIEW_MAX_COUNT     = 100
+
+	WORKFLOW_ON_SUCCESS = "success"
+	WORKFLOW_ON_FAILURE = "failure"
+	WORKFLOW_ON_ALWAYS  = "always"
+
+	WORKFLOW_STATUS_RUNNING = "running"
+	WORKFLOW_STATUS_SUCCESS = "success"
+	WORKFLOW_STATUS_FAILED  = "failed"
+
+	WORKFLOW_JOB_PENDING = "pending"
+	WORKFLOW_JOB_RUNNING = "running"
+	// 工作流中的任务默认最长运行时间 秒
+	WORKFLOW_NODE_TIMEOUT = 3600
+
+	DISPATCH_MODE_LOCK   = "lock"
+	DISPATCH_MODE_LEADER = "dispatch"
+
+	// 分配给worker的任务记录的过期时间 秒
+	JOB_ASSIGN_TTL = 600
+
+	CONCURRENCY_FORBID  = "Forbid"
+	CONCURRENCY_ALLOW   = "Allow"
+	CONCURRENCY_REPLACE = "Replace"
+
+	JOB_REASON_SUCCESS  = "success"
+	JOB_REASON_FAILED   = "failed"
+	JOB_REASON_TIMEOUT  = "timeout"
+	JOB_REASON_KILLED   = "killed"
+	JOB_REASON_SKIPPED  = "skipped"
+	JOB_REASON_REPLACED = "replaced"
+	JOB_REASON_MISSED   = "missed"
+	JOB_REASON_LOCKLOST = "lock_lost"
+	// 获取任务锁出错没有执行  etcd不可用或者创建租约失败
+	JOB_REASON_LOCKFAIL = "lock_failed"
+	// 任务需要的信号量不存在没有执行  信号量被删除或者任务配置错误
+	JOB_REASON_SEMAPHORE = "semaphore_missing"
+
+	RETRY_BACKOFF_FIXED       = "fixed"
+	RETRY_BACKOFF_EXPONENTIAL = "exponential"
+	// 没有设置最大间隔时 指数退避的间隔上限 秒
+	RETRY_MAX_DELAY = 86400
+
+	OUTPUT_STDOUT = "stdout"
+	OUTPUT_STDERR = "stderr"
+
+	// 每次发布到etcd的最多输出行数 超过时丢弃较早的行
+	OUTPUT_BUFFER_LINES = 200
+	// 输出发布到etcd的间隔 毫秒
+	OUTPUT_FLUSH_INTERVAL = 500
+	// 任务结束后输出继续保留的时间 秒
+	JOB_OUTPUT_TTL = 60
+
+	// 日志清理任务默认的执行间隔 秒
+	RETENTION_INTERVAL = 3600
+	// 每批归档和删除的日志条数
+	RETENTION_BATCH = 1000
+	// 日志TTL索引的名字
+	LOG_TTL_INDEX = "createdAt_ttl"
+
+	LOG_BACKEND_MONGO  = "mongo"
+	LOG_BACKEND_FILE   = "file"
+	LOG_BACKEND_MEMORY = "memory"
+
+	// 日志文件和缓冲文件的扩展名
+	LOG_FILE_EXT = ".jsonl"
+	// 重放缓冲日志的最大退避时间 秒
+	LOG_SPOOL_MAX_BACKOFF = 60
+	// 每批写入日志存储的日志条数和超时时间
+	LOG_BATCH_SIZE    = 100
+	LOG_WRITE_TIMEOUT = 5
+	// MongoDB主键重复的错误码
+	MONGO_DUPLICATE_KEY = 11000
+
+	// 查询日志时默认和最大的每页条数
+	LOG_PAGE_SIZE     = 10
+	LOG_MAX_PAGE_SIZE = 100
+
+	ALERT_TYPE_TIMEOUT = 1
+	ALERT_TYPE_FAILED  = 2
+	ALERT_TYPE_KILLED  = 3
+	// 失败的任务再次执行成功
+	ALERT_TYPE_RECOVERED = 4
+	// 执行时间超过任务配置的阈值
+	ALERT_TYPE_LONGRUNNING = 5
+	// leader发现任务错过了执行
+	ALERT_TYPE_MISSED = 6
+
+	// 任务告警配置中的事件名
+	ALERT_EVENT_FAILED      = "failed"
+	ALERT_EVENT_TIMEOUT     = "timeout"
+	ALERT_EVENT_KILLED      = "killed"
+	ALERT_EVENT_LONGRUNNING = "long_running"
+	ALERT_EVENT_MISSED      = "missed"
+
+	// 告警去重状态的目录  保存在etcd中 leader切换后继续生效
+	ALERT_STATE_DIR = "/cron/alert/state/"
+	// 处于失败状态的任务目录  任务恢复时删除
+	ALERT_FAILING_DIR = "/cron/alert/failing/"
+	// 检查去重窗口并发送汇总告警的间隔 秒
+	ALERT_DIGEST_INTERVAL = 30
+	// 告警在所有渠道都发送失败时的重试次数 之后放入死信队列
+	ALERT_DELIVERY_RETRIES = 3
+	// 失去leader后等待正在发送的告警完成的时间 秒
+	ALERT_HANDOFF_TIMEOUT = 10
+
+	ALERT_CHANNEL_SMTP     = "smtp"
+	ALERT_CHANNEL_WEBHOOK  = "webhook"
+	ALERT_CHANNEL_SLACK    = "slack"
+	ALERT_CHANNEL_DINGTALK = "dingtalk"
+	ALERT_CHANNEL_CONSOLE  = "console"
+
+	// 告警在一个渠道的发送结果
+	ALERT_DELIVERY_SUCCESS = "success"
+	ALERT_DELIVERY_FAILED  = "failed"
+
+	// http告警渠道默认的请求超时时间 秒
+	ALERT_HTTP_TIMEOUT = 10
+
+	// 事件总线的类型
+	MQ_TYPE_AMQP   = "amqp"
+	MQ_TYPE_ETCD   = "etcd"
+	MQ_TYPE_MEMORY = "memory"
+	// 告警默认使用的主题
+	MQ_ALERT_TOPIC = "alert"
+	// 等待broker确认发布的超时时间 秒
+	MQ_CONFIRM_TIMEOUT = 5
+	// 重新连接的最大退避时间 秒
+	MQ_MAX_BACKOFF = 30
+	// etcd事件总线的目录 以及每次读取的事件数
+	MQ_ETCD_DIR   = "/cron/mq/"
+	MQ_ETCD_BATCH = 100
+	// 进程内事件总线每个主题的缓冲大小
+	MQ_MEMORY_BUFFER = 1000
+	// 死信队列的后缀 无法处理的事件放入 主题名+后缀
+	MQ_DEAD_SUFFIX = ".dead"
+	// amqp消费时最多同时持有的没有确认的消息数
+	MQ_PREFETCH = 10
+	// 等待发布到事件总线的告警数  超过时丢弃
+	MQ_SEND_BUFFER = 1000
 
 	TIME_FORMAT = "2006-01-02 15:04:05"
 )
@@ -0,0 +1,137 @@
+package common
+
+import (
+	"fmt"
+	"github.com/gorhill/cronexpr"
+	"time"
+)
+
+// 带时区的cron表达式
+type CronSchedule struct {
+	Expr     *cronexpr.Expression
+	Location *time.Location
+}
+
+// 加载IANA时区 为空时使用本机时区
+func LoadLocation(timezone string) (*time.Location, error) {
+	if timezone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("无效的时区 %s : %s", timezone, err)
+	}
+	return loc, nil
+}
+
+// 解析cron表达式 在指定的时区计算执行时间
+func ParseCron(cronExpr, timezone string) (*CronSchedule, error) {
+	loc, err := LoadLocation(timezone)
+	if err != nil {
+		return nil, err
+	}
+
+	expr, err := cronexpr.Parse(cronExpr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CronSchedule{Expr: expr, Location: loc}, nil
+}
+
+// 计算after之后的下次执行时间
+// 在不受夏令时影响的UTC上按本地时间计算 再换算回指定时区
+// 夏令时开始时不存在的本地时间顺延到切换的时刻  同一次切换中的多次执行合并成一次 见Collapsed
+// 结束时重复出现的本地时间只执行一次
+func (c *CronSchedule) Next(after time.Time) time.Time {
+	wall := c.wall(after)
+
+	// 处于回拨后重复的时段时 本地时间对应的第一次出现的时刻已经过去 需要继续向后找
+	for i := 0; i < 100000; i++ {
+		if wall = c.Expr.Next(wall); wall.IsZero() {
+			return wall
+		}
+		if next := c.toLocation(wall); next.After(after) {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// 夏令时开始时被合并到t这次执行的其他执行时间  返回它们不存在的本地时间 没有合并时返回空
+// 例如 */15 2 * * * 在2点跳到3点的那天 02:00顺延到03:00执行 02:15 02:30 02:45被合并
+func (c *CronSchedule) Collapsed(t time.Time) []time.Time {
+	// 切换前最后一刻和t之间的本地时间都不存在 都会顺延到t
+	from, to := c.wall(t.Add(-time.Nanosecond)), c.wall(t)
+
+	var walls []time.Time
+	for wall := c.Expr.Next(from); !wall.IsZero() && !wall.After(to); wall = c.Expr.Next(wall) {
+		walls = append(walls, wall)
+	}
+	if len(walls) <= 1 {
+		return nil
+	}
+	return walls[1:]
+}
+
+// 把时刻换算成指定时区的本地时间 用UTC表示
+func (c *CronSchedule) wall(t time.Time) time.Time {
+	local := t.In(c.Location)
+	return time.Date(local.Year(), local.Month(), local.Day(),
+		local.Hour(), local.Minute(), local.Second(), local.Nanosecond(), time.UTC)
+}
+
+// 把本地时间换算成指定时区的时刻
+func (c *CronSchedule) toLocation(wall time.Time) time.Time {
+	t := time.Date(wall.Year(), wall.Month(), wall.Day(),
+		wall.Hour(), wall.Minute(), wall.Second(), wall.Nanosecond(), c.Location)
+
+	// 本地时间不存在 time.Date会换算到切换前后的某个时刻  统一顺延到切换的时刻
+	if t.Day() != wall.Day() || t.Hour() != wall.Hour() || t.Minute() != wall.Minute() {
+		return c.switchAfter(wall)
+	}
+
+	// 本地时间重复出现 取第一次出现的时刻
+	if _, offset := t.Zone(); c.repeated(t) {
+		_, prevOffset := t.Add(-3 * time.Hour).Zone()
+		return t.Add(-time.Duration(prevOffset-offset) * time.Second)
+	}
+	return t
+}
+
+// 不存在的本地时间之后第一个存在的时刻 也就是夏令时开始的时刻
+// 切换前后一天内本地时间随时刻递增 按秒二分查找
+func (c *CronSchedule) switchAfter(wall time.Time) time.Time {
+	lo, hi := wall.Add(-24*time.Hour).Unix(), wall.Add(24*time.Hour).Unix()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if c.wall(time.Unix(mid, 0)).After(wall) {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return time.Unix(lo, 0).In(c.Location)
+}
+
+// 判断t的本地时间是否是时钟回拨后第二次出现
+func (c *CronSchedule) repeated(t time.Time) bool {
+	_, offset := t.Zone()
+	_, prevOffset := t.Add(-3 * time.Hour).Zone()
+	if prevOffset <= offset {
+		return false
+	}
+
+	// 回拨前 同一个本地时间对应的时刻
+	_, earlierOffset := t.Add(-time.Duration(prevOffset-offset) * time.Second).Zone()
+	return earlierOffset == prevOffset
+}
+
+// 计算after之后的n次执行时间
+func (c *CronSchedule) NextN(after time.Time, n int) []time.Time {
+	times := make([]time.Time, 0, n)
+	for t := c.Next(after); !t.IsZero() && len(times) < n; t = c.Next(t) {
+		times = append(times, t)
+	}
+	return times
+}
@@ -0,0 +1,82 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func mustSchedule(t *testing.T, cronExpr string) *CronSchedule {
+	t.Helper()
+	schedule, err := ParseCron(cronExpr, "Europe/Berlin")
+	if err != nil {
+		t.Skip("无法加载时区 : ", err)
+	}
+	return schedule
+}
+
+func berlin(t *testing.T, value string) time.Time {
+	t.Helper()
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("无法加载时区 : ", err)
+	}
+	tm, err := time.ParseInLocation(TIME_FORMAT, value, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm
+}
+
+// 2024-03-31 柏林02:00跳到03:00  不存在的本地时间都顺延到03:00 合并成一次执行 其余的由Collapsed返回
+func TestCronNextSpringForward(t *testing.T) {
+	cases := []struct {
+		expr      string
+		collapsed []string
+		following string
+	}{
+		{"*/15 2 * * *", []string{"2024-03-31 02:15:00", "2024-03-31 02:30:00", "2024-03-31 02:45:00"}, "2024-04-01 02:00:00"},
+		{"30 2 * * *", nil, "2024-04-01 02:30:00"},
+		{"30,45 2 * * *", []string{"2024-03-31 02:45:00"}, "2024-04-01 02:30:00"},
+		{"0 2,3 * * *", []string{"2024-03-31 03:00:00"}, "2024-04-01 02:00:00"},
+	}
+
+	for _, c := range cases {
+		schedule := mustSchedule(t, c.expr)
+
+		next := schedule.Next(berlin(t, "2024-03-31 01:00:00"))
+		if want := time.Date(2024, 3, 31, 1, 0, 0, 0, time.UTC); !next.Equal(want) {
+			t.Errorf("%s : 下次执行时间 %s 期望 %s", c.expr, next.UTC(), want)
+		}
+
+		collapsed := schedule.Collapsed(next)
+		if len(collapsed) != len(c.collapsed) {
+			t.Fatalf("%s : 合并的执行时间 %v 期望 %v", c.expr, collapsed, c.collapsed)
+		}
+		for i, wall := range collapsed {
+			if wall.Format(TIME_FORMAT) != c.collapsed[i] {
+				t.Errorf("%s : 合并的执行时间 %s 期望 %s", c.expr, wall.Format(TIME_FORMAT), c.collapsed[i])
+			}
+		}
+
+		if following := schedule.Next(next); !following.Equal(berlin(t, c.following)) {
+			t.Errorf("%s : 再下次执行时间 %s 期望 %s", c.expr, following, c.following)
+		}
+	}
+}
+
+// 2024-10-27 柏林03:00回拨到02:00  重复出现的本地时间只执行第一次
+func TestCronNextFallBack(t *testing.T) {
+	schedule := mustSchedule(t, "30 2 * * *")
+
+	next := schedule.Next(berlin(t, "2024-10-27 01:00:00"))
+	if want := time.Date(2024, 10, 27, 0, 30, 0, 0, time.UTC); !next.Equal(want) {
+		t.Fatalf("下次执行时间 %s 期望 %s", next.UTC(), want)
+	}
+	if collapsed := schedule.Collapsed(next); len(collapsed) != 0 {
+		t.Errorf("没有夏令时跳过时不应该合并执行 : %v", collapsed)
+	}
+
+	if following := schedule.Next(next); !following.Equal(berlin(t, "2024-10-28 02:30:00")) {
+		t.Errorf("重复的本地时间执行了两次 再下次执行时间 %s", following)
+	}
+}
@@ -0,0 +1,40 @@
+package common
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+)
+
+type DispatchCfg struct {
+	Mode string `toml:"mode"` // 任务分配方式 lock / dispatch
+}
+
+var Dispatch *DispatchCfg
+
+func InitDispatchCfg(path string) error {
+	cfg := &DispatchCfg{}
+	if _, err := toml.DecodeFile(path, cfg); err != nil {
+		return err
+	}
+
+	// 默认使用抢锁的方式 兼容之前的部署
+	if cfg.Mode == "" {
+		cfg.Mode = DISPATCH_MODE_LOCK
+	}
+	if cfg.Mode != DISPATCH_MODE_LOCK && cfg.Mode != DISPATCH_MODE_LEADER {
+		return fmt.Errorf("不支持的任务分配方式 : %s", cfg.Mode)
+	}
+
+	Dispatch = cfg
+	return nil
+}
+
+// 是否由leader分配任务
+func IsDispatchMode() bool {
+	return Dispatch != nil && Dispatch.Mode == DISPATCH_MODE_LEADER
+}
+
+// 任务分配给worker后在etcd中的key
+func JobAssignKey(trigger *JobTrigger) string {
+	return fmt.Sprintf("%s%s/%s/%s", JOB_ASSIGN_DIR, trigger.Worker, trigger.Name, trigger.TickID())
+}
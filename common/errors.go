@@ -3,7 +3,26 @@ package common
 import "errors"
 
 var (
-	ERR_NO_LOCAL_IP_FOUND = errors.New("无法找到本地IP")
-	ERR_LOCK_ALREADY_REQUIRED = errors.New("锁已被占用")
+	ERR_NO_LOCAL_IP_FOUND       = errors.New("无法找到本地IP")
+	ERR_LOCK_ALREADY_REQUIRED   = errors.New("锁已被占用")
+	ERR_JOB_CONCURRENCY_LIMIT   = errors.New("任务并发执行的实例数已达到上限")
+	ERR_JOB_NOT_FOUND           = errors.New("任务不存在")
+	ERR_JOB_PAUSED              = errors.New("任务已暂停")
+	ERR_JOB_MODIFIED            = errors.New("任务已被修改 请重试")
+	ERR_NO_WORKER_AVAILABLE     = errors.New("没有可用的worker节点")
+	ERR_WORKFLOW_NOT_FOUND      = errors.New("工作流不存在")
+	ERR_WORKFLOW_CYCLE          = errors.New("工作流存在循环依赖")
+	ERR_RUN_STORE_UNAVAILABLE   = errors.New("工作流运行记录存储没有初始化")
+	ERR_INVALID_CURSOR          = errors.New("无效的分页游标")
+	ERR_LOG_SPOOL_FULL          = errors.New("日志缓冲已满")
+	ERR_LOG_STORE_UNAVAILABLE   = errors.New("日志存储没有初始化")
+	ERR_ALERT_STORE_UNAVAILABLE = errors.New("告警存储没有初始化")
+	ERR_ALERT_NOT_FOUND         = errors.New("告警不存在")
+	ERR_EVENT_BUS_CLOSED        = errors.New("事件总线已关闭")
+	ERR_EVENT_BUS_FULL          = errors.New("事件总线缓冲已满")
+	ERR_ALERT_QUEUE_FULL        = errors.New("告警发送队列已满")
+	ERR_NO_LEADER               = errors.New("当前没有leader")
+	ERR_SEMAPHORE_NOT_FOUND     = errors.New("信号量不存在")
+	ERR_SEMAPHORE_FULL          = errors.New("信号量的名额已被占满")
+	ERR_SEMAPHORE_TIMEOUT       = errors.New("等待信号量超时 跳过本次执行")
 )
-
@@ -0,0 +1,185 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 当前leader的信息
+type LeaderInfo struct {
+	IP       string `json:"ip"`       // leader的ip
+	Hostname string `json:"hostname"` // leader的主机名
+	Since    int64  `json:"since"`    // 成为leader的时间 毫秒
+	Term     int64  `json:"term"`     // 任期 leader key的创建版本 每次选举都会增大
+	Self     bool   `json:"self"`     // 是否是当前节点
+}
+
+// master的leader选举  所有master竞选同一个key 同一时间只有一个leader
+type LeaderElector struct {
+	info    *LeaderInfo // 本节点的信息
+	leading int32       // 本节点当前是否为leader
+	term    int64       // 本节点当选的任期
+
+	lock   sync.Mutex
+	onGain []func() // 成为leader后依次调用
+	onLoss []func() // 失去leader后依次调用
+}
+
+var Elector = &LeaderElector{}
+
+// 开始参加选举  选举在后台进行 成为leader和失去leader时调用注册的回调
+func InitLeader() error {
+	ip, err := GetLocalIP()
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	Elector.info = &LeaderInfo{IP: ip, Hostname: hostname}
+
+	go Elector.campaignLoop()
+	return nil
+}
+
+// 当前节点是否为leader
+func IsLeader() bool {
+	return atomic.LoadInt32(&Elector.leading) == 1
+}
+
+// 注册成为leader后的回调  需要在InitLeader之前注册
+func OnLeaderGain(f func()) {
+	Elector.lock.Lock()
+	defer Elector.lock.Unlock()
+	Elector.onGain = append(Elector.onGain, f)
+}
+
+// 注册失去leader后的回调  回调返回后才会重新参加选举
+func OnLeaderLoss(f func()) {
+	Elector.lock.Lock()
+	defer Elector.lock.Unlock()
+	Elector.onLoss = append(Elector.onLoss, f)
+}
+
+// 只在leader上运行的后台任务  成为leader时启动 失去leader时取消ctx并等待任务退出
+func RunAsLeader(task func(ctx context.Context)) {
+	var cancelFunc context.CancelFunc
+	var done chan struct{}
+
+	OnLeaderGain(func() {
+		var ctx context.Context
+		ctx, cancelFunc = context.WithCancel(context.Background())
+		done = make(chan struct{})
+		go func(done chan struct{}) {
+			defer close(done)
+			task(ctx)
+		}(done)
+	})
+	OnLeaderLoss(func() {
+		if cancelFunc != nil {
+			cancelFunc()
+			<-done
+		}
+	})
+}
+
+// 查询当前的leader  竞选key中创建版本最小的就是leader
+func CurrentLeader() (*LeaderInfo, error) {
+	getResp, err := ETCD.KV.Get(context.TODO(), MASTER_ELECTION_KEY+"/", clientv3.WithFirstCreate()...)
+	if err != nil {
+		return nil, err
+	}
+	if len(getResp.Kvs) == 0 {
+		return nil, ERR_NO_LEADER
+	}
+
+	kv := getResp.Kvs[0]
+	leader := &LeaderInfo{}
+	if err := json.Unmarshal(kv.Value, leader); err != nil {
+		return nil, err
+	}
+	leader.Term = kv.CreateRevision
+	leader.Self = IsLeader() && leader.Term == atomic.LoadInt64(&Elector.term)
+	return leader, nil
+}
+
+// 循环参加选举  租约丢失后重新参加
+func (e *LeaderElector) campaignLoop() {
+	backoff := time.Second
+	for {
+		if err := e.campaign(); err != nil {
+			fmt.Println("参加leader选举出错 : ", err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > MASTER_MAX_BACKOFF*time.Second {
+				backoff = MASTER_MAX_BACKOFF * time.Second
+			}
+			continue
+		}
+		backoff = time.Second
+	}
+}
+
+// 参加一次选举  成为leader后一直等到租约丢失
+func (e *LeaderElector) campaign() error {
+	session, err := concurrency.NewSession(ETCD.Client, concurrency.WithTTL(MASTER_LEASE_TTL))
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	info := *e.info
+	info.Since = time.Now().UnixNano() / 1000000
+	value, err := json.Marshal(&info)
+	if err != nil {
+		return err
+	}
+
+	// 阻塞直到成为leader 租约丢失时放弃竞选
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	go func() {
+		select {
+		case <-session.Done():
+			cancelFunc()
+		case <-ctx.Done():
+		}
+	}()
+
+	election := concurrency.NewElection(session, MASTER_ELECTION_KEY)
+	if err := election.Campaign(ctx, string(value)); err != nil {
+		return err
+	}
+
+	atomic.StoreInt64(&e.term, election.Rev())
+	atomic.StoreInt32(&e.leading, 1)
+	fmt.Println("成为leader 任期 : ", election.Rev())
+	e.callback(true)
+
+	// 租约丢失后不再是leader
+	<-session.Done()
+
+	atomic.StoreInt32(&e.leading, 0)
+	fmt.Println("失去leader 任期 : ", election.Rev())
+	e.callback(false)
+	return nil
+}
+
+// 依次调用成为或者失去leader的回调
+func (e *LeaderElector) callback(gain bool) {
+	e.lock.Lock()
+	funcs := e.onLoss
+	if gain {
+		funcs = e.onGain
+	}
+	funcs = append([]func(){}, funcs...)
+	e.lock.Unlock()
+
+	for _, f := range funcs {
+		f()
+	}
+}
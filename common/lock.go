@@ -4,199 +4,141 @@ import (
 	"context"
 	"fmt"
 	"github.com/coreos/etcd/clientv3"
-	"github.com/coreos/etcd/mvcc/mvccpb"
 )
 
-type Lock struct {
-	ctx        context.Context
-	cancelFunc context.CancelFunc
-	locked     bool
-}
-
-type MasterLock struct {
-	ip      string
-	etcd    *EtcdManager
-	lock    *Lock
-	leaseID clientv3.LeaseID
-}
-
+// 任务执行锁  每把锁有自己的租约和续租 互不影响
 type JobLock struct {
-	jobName string
-	etcd    *EtcdManager
-	lock    *Lock
-	leaseID clientv3.LeaseID
-}
-
-var Locks *Lock
-var Master *MasterLock
-
-// 选举leader
-func InitLeader() error {
-	// 初始化锁失败
-	if err := InitLock(); err != nil {
-		return err
-	}
-
-	Master = &MasterLock{}
-	if err := Master.initMasterLock(); err != nil {
-		return err
-	}
-
-	if err := Master.tryLockMaster(); err != nil {
-		return err
-	}
-
-	return nil
+	jobName  string
+	etcd     *EtcdManager
+	slots    int64  // 允许并发执行时同时持有锁的最大数目 0表示不限制
+	tick     string // 允许并发执行时 本次执行对应的触发标识
+	parallel bool   // 是否允许同一个任务并发执行
+
+	ctx        context.Context    // 用于取消自动续租
+	cancelFunc context.CancelFunc // 释放锁时取消自动续租
+	leaseID    clientv3.LeaseID
+	locked     bool
+	revision   int64         // 抢到锁时etcd的版本 作为fencing token 每次抢锁都会增大
+	lost       chan struct{} // 持有锁期间租约丢失时关闭
 }
 
-func InitLock() error {
-	// 创建ctx 用于取消操作  取消自动续租
-	ctx, cancelFunc := context.WithCancel(context.TODO())
-
-	Locks = &Lock{
-		ctx:        ctx,
-		cancelFunc: cancelFunc,
+// 初始化任务执行锁
+func CreateJobLock(jobName string) *JobLock {
+	return &JobLock{
+		jobName: jobName,
+		etcd:    ETCD,
+		lost:    make(chan struct{}),
 	}
-
-	return nil
 }
 
-// 初始化master锁
-func (m *MasterLock) initMasterLock() error {
-	// 得到本机ip
-	ip, err := GetLocalIP()
-	if err != nil {
-		return err
+// 初始化允许并发执行的任务锁
+// 同一次触发只能被一个worker抢到  同时最多有slots个实例持有锁
+func CreateJobSlotLock(jobName string, slots int64, tick string) *JobLock {
+	return &JobLock{
+		jobName:  jobName,
+		etcd:     ETCD,
+		slots:    slots,
+		tick:     tick,
+		parallel: true,
+		lost:     make(chan struct{}),
 	}
-
-	m.ip = ip
-	m.etcd = ETCD
-	m.lock = Locks
-
-	return nil
 }
 
-// 抢leader/master 分布式锁 成功的成为leader
-func (m *MasterLock) tryLockMaster() error {
-	// 创建租约  默认5s
-	leaseGrant, err := ETCD.Lease.Grant(context.TODO(), 5)
+// 尝试上锁
+func (j *JobLock) TryLockJob() error {
+	// 创建租约
+	leaseGrant, err := j.etcd.Lease.Grant(context.TODO(), JOB_LOCK_TTL)
 	if err != nil {
 		return err
 	}
 
 	leaseId := leaseGrant.ID
+	j.ctx, j.cancelFunc = context.WithCancel(context.TODO())
 
 	// 自动续租
-	leaseAliveChan, err := m.etcd.Lease.KeepAlive(m.lock.ctx, leaseId)
+	leaseKeepChan, err := j.etcd.Lease.KeepAlive(j.ctx, leaseId)
 	if err != nil {
-		// 取消自动续租
-		m.lock.cancelFunc()
-		// 释放租约
-		m.etcd.Lease.Revoke(context.TODO(), leaseId)
+		j.cancelFunc()
+		j.etcd.Lease.Revoke(context.TODO(), leaseId)
 		return err
 	}
 
-	// 处理自动续租的协程
-	go func() {
-		for {
-			select {
-			case keepChan := <-leaseAliveChan:
-				if keepChan == nil {
-					m.lock.locked = false
-					// 往告警模块发送一个消息让其停止告警
-					StopAlerts()
-					goto END
-				}
-			}
-		}
-	END:
-	}()
-
-	// 创建txn事务
-	txn := m.etcd.KV.Txn(context.TODO())
-	lockKey := MASTER_LOCK_DIR + m.ip
-
-	//事务抢锁
-	txn.If(clientv3.Compare(clientv3.CreateRevision(lockKey), "=", 0)).
-		Then(clientv3.OpPut(lockKey, "", clientv3.WithLease(leaseId))).Else(clientv3.OpGet(lockKey))
-
-	// 提交事务
-	txnResp, err := txn.Commit()
+	// 抢锁成功返回   失败释放租约
+	revision, err := j.acquire(leaseId)
 	if err != nil {
-		// 取消自动续租
-		m.lock.cancelFunc()
-		// 释放租约
-		m.etcd.Lease.Revoke(context.TODO(), leaseId)
+		j.cancelFunc()
+		j.etcd.Lease.Revoke(context.TODO(), leaseId)
 		return err
 	}
 
-	// 判断抢锁是否成功
-	if !txnResp.Succeeded {
-		// 锁被占用
-		// 取消自动续租
-		m.lock.cancelFunc()
-		// 释放租约
-		m.etcd.Lease.Revoke(context.TODO(), leaseId)
-		return ERR_LOCK_ALREADY_REQUIRED
-	}
+	j.leaseID = leaseId
+	j.revision = revision
+	j.locked = true
 
-	m.lock.locked = true
-	m.leaseID = leaseId
+	// 处理自动续租应答  没有释放锁时续租停止 说明租约已经丢失 锁可能已经被其他worker抢到
+	go func() {
+		for range leaseKeepChan {
+		}
+		if j.ctx.Err() == nil {
+			close(j.lost)
+		}
+	}()
 
 	return nil
 }
 
-// unlock
-func (m *MasterLock) unlockMaster() {
-	if m.lock.locked {
-		m.lock.cancelFunc()
-		m.etcd.Lease.Revoke(context.TODO(), m.leaseID)
-	}
+// 抢到锁时的fencing token  外部系统可以拒绝比已经见过的token更小的写入
+func (j *JobLock) Revision() int64 {
+	return j.revision
 }
 
-// 初始化任务执行锁
-func CreateJobLock(jobName string) *JobLock {
-	return &JobLock{
-		jobName: jobName,
-		etcd:    ETCD,
-		lock:    Locks,
-	}
+// 持有锁期间租约丢失时关闭
+func (j *JobLock) Lost() <-chan struct{} {
+	return j.lost
 }
 
-// 尝试上锁
-func (j *JobLock) TryLockJob() error {
-	// 创建租约
-	leaseGrant, err := j.etcd.Lease.Grant(context.TODO(), 5)
-	if err != nil {
-		return err
+// 用租约抢占任务锁对应的key  返回抢到锁时的版本
+func (j *JobLock) acquire(leaseId clientv3.LeaseID) (int64, error) {
+	// 不允许并发执行 整个任务只有一把锁
+	if !j.parallel {
+		return j.putIfAbsent(JOB_LOCK_KEY+j.jobName, leaseId)
 	}
 
-	leaseId := leaseGrant.ID
-
-	// 自动续租
-	leaseKeepChan, err := j.etcd.Lease.KeepAlive(j.lock.ctx, leaseId)
+	// 先抢本次触发对应的锁  保证同一次触发只会被一个worker执行
+	// 使用单独的租约 释放锁或者没有抢到并发名额时也保留到过期  其他worker不会再执行这次触发
+	tickKey := fmt.Sprintf("%s%s/tick/%s", JOB_LOCK_KEY, j.jobName, j.tick)
+	tickLease, err := j.etcd.Lease.Grant(context.TODO(), JOB_TICK_TTL)
 	if err != nil {
-		j.lock.cancelFunc()
-		j.etcd.Lease.Revoke(context.TODO(), leaseId)
-		return err
+		return 0, err
+	}
+	revision, err := j.putIfAbsent(tickKey, tickLease.ID)
+	if err != nil {
+		j.etcd.Lease.Revoke(context.TODO(), tickLease.ID)
+		return 0, err
+	}
+	if j.slots <= 0 {
+		return revision, nil
 	}
 
-	// 处理自动续租应答
-	go func() {
-		for {
-			select {
-			case keepChan := <-leaseKeepChan:
-				if keepChan == nil {
-					goto END
-				}
-			}
-		END:
+	// 再从slots个并发名额中抢一个  都被占用说明并发数已达到上限
+	for i := int64(0); i < j.slots; i++ {
+		slotKey := fmt.Sprintf("%s%s/slot/%d", JOB_LOCK_KEY, j.jobName, i)
+		revision, err := j.putIfAbsent(slotKey, leaseId)
+		if err == nil {
+			return revision, nil
 		}
-	}()
+		if err != ERR_LOCK_ALREADY_REQUIRED {
+			return 0, err
+		}
+	}
+	return 0, ERR_JOB_CONCURRENCY_LIMIT
+}
 
+// 事务抢锁 key不存在时写入 已存在返回ERR_LOCK_ALREADY_REQUIRED
+// 写入成功时返回事务的版本 也就是锁key的创建版本
+func (j *JobLock) putIfAbsent(lockKey string, leaseId clientv3.LeaseID) (int64, error) {
 	// 创建事务
 	txn := j.etcd.KV.Txn(context.TODO())
-	lockKey := JOB_LOCK_KEY + j.jobName
 
 	// 事务抢锁
 	txn.If(clientv3.Compare(clientv3.CreateRevision(lockKey), "=", 0)).
@@ -205,52 +147,19 @@ func (j *JobLock) TryLockJob() error {
 	// 提交事务
 	txnResp, err := txn.Commit()
 	if err != nil {
-		j.lock.cancelFunc()
-		j.etcd.Lease.Revoke(context.TODO(), leaseId)
-		return err
+		return 0, err
 	}
 
-	// 抢锁成功返回   失败释放租约
 	if !txnResp.Succeeded {
-		j.lock.cancelFunc()
-		j.etcd.Lease.Revoke(context.TODO(), leaseId)
-		return ERR_LOCK_ALREADY_REQUIRED
+		return 0, ERR_LOCK_ALREADY_REQUIRED
 	}
-
-	j.leaseID = leaseId
-	j.lock.locked = true
-
-	return nil
+	return txnResp.Header.Revision, nil
 }
 
 func (j *JobLock) UnLock() {
-	if j.lock.locked {
-		j.lock.cancelFunc()
+	if j.locked {
+		j.locked = false
+		j.cancelFunc()
 		j.etcd.Lease.Revoke(context.TODO(), j.leaseID)
 	}
 }
-
-// 监听leader是否挂了 如果挂了马上参加选举
-func WatchMaster(path string) {
-	for {
-		watcher := clientv3.NewWatcher(ETCD.Client)
-		watchChan := watcher.Watch(context.TODO(), MASTER_LOCK_DIR, clientv3.WithPrefix())
-
-		for watch := range watchChan {
-			for _, event := range watch.Events {
-				switch event.Type {
-				case mvccpb.DELETE:
-					// 如果master挂了 那么之前注册的key就会过期 delete掉
-					// 重新开始一次选举
-					if err := InitLeader(); err == nil {
-						// 抢锁成功 成为master
-						Master.lock.locked = true
-						if err := InitAlert(path); err != nil {
-							fmt.Println("重新选举后初始化alert出错")
-						}
-					}
-				}
-			}
-		}
-	}
-}
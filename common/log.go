@@ -1,51 +1,91 @@
 package common
 
 import (
-	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"path/filepath"
+	"sync/atomic"
 	"time"
 )
 
 type JobLog struct {
-	JobName      string `json:"jobName" bson:"jobName"`           // 任务名
-	Command      string `json:"command" bson:"command"`           // 执行的命令
-	OutPut       string `json:"outPut" bson:"outPut"`             // 任务执行的输出
-	Error        string `json:"error" bson:"error"`               // 执行的错误信息
-	PlanTime     int64  `json:"planTime" bson:"planTime"`         // 计划执行时间
-	ScheduleTime int64  `json:"scheduleTime" bson:"scheduleTime"` // 调度时间
-	StartTime    int64  `json:"startTime" bson:"startTime"`       // 时间开始时间
-	EndTime      int64  `json:"endTime" bson:"endTime"`           // 执行完成时间
-}
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`          // 日志id 写入前生成
+	JobName      string             `json:"jobName" bson:"jobName"`           // 任务名
+	Command      string             `json:"command" bson:"command"`           // 执行的命令
+	OutPut       string             `json:"outPut" bson:"outPut"`             // 任务执行的输出
+	Error        string             `json:"error" bson:"error"`               // 执行的错误信息
+	PlanTime     int64              `json:"planTime" bson:"planTime"`         // 计划执行时间
+	ScheduleTime int64              `json:"scheduleTime" bson:"scheduleTime"` // 调度时间
+	StartTime    int64              `json:"startTime" bson:"startTime"`       // 时间开始时间
+	EndTime      int64              `json:"endTime" bson:"endTime"`           // 执行完成时间
+	Attempt      int64              `json:"attempt" bson:"attempt"`           // 第几次执行 从1开始
+	Reason       string             `json:"reason" bson:"reason"`             // 结束原因 success failed timeout killed skipped replaced missed lock_lost lock_failed semaphore_missing
+	Trigger      string             `json:"trigger" bson:"trigger"`           // 触发类型 cron / manual / workflow / misfire
+	User         string             `json:"user" bson:"user"`                 // 手动触发任务的用户
+	ExitCode     int                `json:"exitCode" bson:"exitCode"`         // 进程的退出码 没有执行或者被信号终止时为-1
+	Signal       string             `json:"signal" bson:"signal"`             // 终止进程的信号
+	WorkerIP     string             `json:"workerIp" bson:"workerIp"`         // 执行任务的worker
+	Hostname     string             `json:"hostname" bson:"hostname"`         // 执行任务的worker主机名
+	UserTime     int64              `json:"userTime" bson:"userTime"`         // 用户态CPU时间 毫秒
+	SysTime      int64              `json:"sysTime" bson:"sysTime"`           // 内核态CPU时间 毫秒
+	MaxRSS       int64              `json:"maxRss" bson:"maxRss"`             // 最大常驻内存 KB
 
-type Log struct {
-	JobName string `json:"jobName"`
-	Limit   int64  `json:"limit"`
-	Skip    int64  `json:"skip"`
+	WorkflowRunID string    `json:"workflowRunId" bson:"workflowRunId"` // 由工作流触发时 工作流的运行id
+	CreatedAt     time.Time `json:"createdAt" bson:"createdAt"`         // 日志的写入时间 用于TTL索引
 }
 
 type LogSink struct {
-	*Mongo
+	Store          LogStore // 日志存储
 	LogChan        chan *JobLog
 	AutoCommitChan chan *LogBatch
+	Spool          *LogSpool // 日志存储不可用时的本地缓冲 为nil表示不缓冲
+
+	written int64 // 写入日志存储的日志条数
+	dropped int64 // 丢弃的日志条数
 }
 
 type LogBatch struct {
-	logs []interface{}
+	logs []*JobLog
+}
+
+// 日志写入的统计
+type LogSinkStats struct {
+	Pending  int64 `json:"pending"`  // 等待批量写入的日志条数
+	Buffered int64 `json:"buffered"` // 缓冲在本地磁盘等待重放的日志条数
+	Written  int64 `json:"written"`  // 已经写入日志存储的日志条数
+	Dropped  int64 `json:"dropped"`  // 无法写入也无法缓冲而丢弃的日志条数
 }
 
 var Sink *LogSink
 
-func InitLogSink(path string) error {
-	mc, err := MongoConn(path)
+// 初始化日志写入  master和worker可能部署在同一台机器 本地缓冲使用各自的子目录
+func InitLogSink(path, mongoPath, role string) error {
+	cfg, err := loadLogCfg(path)
+	if err != nil {
+		return err
+	}
+	store, err := NewLogStore(cfg, mongoPath)
 	if err != nil {
 		return err
 	}
 
 	Sink = &LogSink{
-		Mongo:          mc,
+		Store:          store,
 		LogChan:        make(chan *JobLog, 1000),
 		AutoCommitChan: make(chan *LogBatch, 1000),
 	}
 
+	// 初始化本地缓冲 并重放上次没有写入的日志
+	if cfg.SpoolDir != "" {
+		spool, err := OpenLogSpool(filepath.Join(cfg.SpoolDir, role), cfg.SpoolMaxSize*1024*1024)
+		if err != nil {
+			fmt.Println("初始化日志缓冲出错 日志存储不可用时日志会丢失 : ", err)
+		} else {
+			Sink.Spool = spool
+			go spool.Replay(Sink.insert)
+		}
+	}
+
 	// 初始化日志存储协程
 	go Sink.writeLoop()
 
@@ -59,7 +99,7 @@ func (l *LogSink) writeLoop() {
 	for {
 		select {
 		case log := <-l.LogChan:
-			// 写入MongoDB 每次写入需要进过网络 耗时  所以按批次写入
+			// 写入日志存储 每次写入需要进过网络 耗时  所以按批次写入
 			if batch == nil {
 				batch = &LogBatch{}
 				// 让这个batch超时自动提交
@@ -73,8 +113,8 @@ func (l *LogSink) writeLoop() {
 
 			batch.logs = append(batch.logs, log)
 			// 如果批次里的日志已经到达一定数目 那么就直接提交这个批次
-			if len(batch.logs) >= 100 {
-				l.Collection.InsertMany(context.TODO(), batch.logs)
+			if len(batch.logs) >= LOG_BATCH_SIZE {
+				l.commit(batch.logs)
 				batch = nil
 				// 取消定时器
 				commitTimer.Stop()
@@ -88,16 +128,72 @@ func (l *LogSink) writeLoop() {
 				continue
 			}
 
-			l.Collection.InsertMany(context.TODO(), timeOutBatch.logs)
+			l.commit(timeOutBatch.logs)
 			batch = nil
 		}
 	}
 }
 
+// 提交一个批次  写入失败时放入本地缓冲
+func (l *LogSink) commit(logs []*JobLog) {
+	// 缓冲中还有日志时 新的批次排在后面 保证按顺序写入
+	if l.Spool != nil && !l.Spool.Empty() {
+		l.spill(logs)
+		return
+	}
+
+	if err := l.insert(logs); err != nil {
+		fmt.Println("写入日志出错 写入本地缓冲 : ", err)
+		l.spill(logs)
+	}
+}
+
+// 写入本地缓冲  无法缓冲时丢弃
+func (l *LogSink) spill(logs []*JobLog) {
+	if l.Spool == nil {
+		atomic.AddInt64(&l.dropped, int64(len(logs)))
+		return
+	}
+	if err := l.Spool.Append(logs); err != nil {
+		fmt.Println("写入日志缓冲出错 丢弃", len(logs), "条日志 : ", err)
+		atomic.AddInt64(&l.dropped, int64(len(logs)))
+	}
+}
+
+// 批量写入日志存储
+func (l *LogSink) insert(logs []*JobLog) error {
+	if err := l.Store.Append(logs); err != nil {
+		return err
+	}
+	atomic.AddInt64(&l.written, int64(len(logs)))
+	return nil
+}
+
+// 返回日志写入的统计
+func (l *LogSink) Stats() *LogSinkStats {
+	stats := &LogSinkStats{
+		Pending: int64(len(l.LogChan)),
+		Written: atomic.LoadInt64(&l.written),
+		Dropped: atomic.LoadInt64(&l.dropped),
+	}
+	if l.Spool != nil {
+		stats.Buffered = l.Spool.Count()
+	}
+	return stats
+}
+
 func (l *LogSink) Append(log *JobLog) {
-	// chan 有可能因为日志太多而阻塞  阻塞就直接丢弃日志
+	if log.ID.IsZero() {
+		log.ID = primitive.NewObjectID()
+	}
+	if log.CreatedAt.IsZero() {
+		log.CreatedAt = time.Now()
+	}
+
+	// chan 有可能因为日志太多而阻塞  阻塞时写入本地缓冲
 	select {
 	case l.LogChan <- log:
 	default:
+		l.spill([]*JobLog{log})
 	}
 }
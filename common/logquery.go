@@ -0,0 +1,198 @@
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 日志查询条件  为空的条件不参与过滤
+type Log struct {
+	JobName   string `json:"jobName"`   // 任务名 精确匹配
+	JobPrefix string `json:"jobPrefix"` // 任务名前缀
+	StartFrom int64  `json:"startFrom"` // 开始执行时间不早于 毫秒
+	StartTo   int64  `json:"startTo"`   // 开始执行时间早于 毫秒
+	Reason    string `json:"reason"`    // 结束原因 success failed timeout ...
+	Worker    string `json:"worker"`    // 执行任务的worker ip或者主机名
+	Keyword   string `json:"keyword"`   // 在输出和错误信息中全文搜索
+	Cursor    string `json:"cursor"`    // 上一页返回的nextCursor 为空表示第一页
+	Limit     int64  `json:"limit"`     // 每页条数
+}
+
+// 一页日志  按开始时间倒序
+type LogPage struct {
+	Logs       []*JobLog `json:"logs"`
+	Total      int64     `json:"total"`      // 满足条件的日志总数
+	NextCursor string    `json:"nextCursor"` // 下一页的游标 没有下一页时为空
+}
+
+// 生成mongo的过滤条件 不包含游标
+func (l *Log) Filter() bson.M {
+	filter := bson.M{}
+
+	if l.JobName != "" {
+		filter["jobName"] = l.JobName
+	} else if l.JobPrefix != "" {
+		filter["jobName"] = bson.M{"$regex": "^" + regexp.QuoteMeta(l.JobPrefix)}
+	}
+
+	startTime := bson.M{}
+	if l.StartFrom > 0 {
+		startTime["$gte"] = l.StartFrom
+	}
+	if l.StartTo > 0 {
+		startTime["$lt"] = l.StartTo
+	}
+	if len(startTime) > 0 {
+		filter["startTime"] = startTime
+	}
+
+	if l.Reason != "" {
+		filter["reason"] = l.Reason
+	}
+	if l.Worker != "" {
+		filter["$or"] = bson.A{bson.M{"workerIp": l.Worker}, bson.M{"hostname": l.Worker}}
+	}
+	if l.Keyword != "" {
+		filter["$text"] = bson.M{"$search": l.Keyword}
+	}
+	return filter
+}
+
+// 在过滤条件上加上游标  只返回排在游标之后的日志
+func (l *Log) CursorFilter() (bson.M, error) {
+	filter := l.Filter()
+	if l.Cursor == "" {
+		return filter, nil
+	}
+
+	startTime, id, err := decodeLogCursor(l.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	after := bson.M{"$or": bson.A{
+		bson.M{"startTime": bson.M{"$lt": startTime}},
+		bson.M{"startTime": startTime, "_id": bson.M{"$lt": id}},
+	}}
+	return bson.M{"$and": bson.A{filter, after}}, nil
+}
+
+// 游标由最后一条日志的开始时间和id组成
+func EncodeLogCursor(log *JobLog) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", log.StartTime, log.ID.Hex())))
+}
+
+func decodeLogCursor(cursor string) (int64, primitive.ObjectID, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, primitive.NilObjectID, ERR_INVALID_CURSOR
+	}
+	parts := strings.SplitN(string(data), ":", 2)
+	if len(parts) != 2 {
+		return 0, primitive.NilObjectID, ERR_INVALID_CURSOR
+	}
+	startTime, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, primitive.NilObjectID, ERR_INVALID_CURSOR
+	}
+	id, err := primitive.ObjectIDFromHex(parts[1])
+	if err != nil {
+		return 0, primitive.NilObjectID, ERR_INVALID_CURSOR
+	}
+	return startTime, id, nil
+}
+
+// 每页条数 没有设置时使用默认值
+func (l *Log) PageSize() int64 {
+	if l.Limit <= 0 {
+		return LOG_PAGE_SIZE
+	}
+	return l.Limit
+}
+
+// 判断日志是否满足查询条件  用于不支持查询语言的存储
+func (l *Log) Match(log *JobLog) bool {
+	if l.JobName != "" && log.JobName != l.JobName {
+		return false
+	}
+	if l.JobName == "" && l.JobPrefix != "" && !strings.HasPrefix(log.JobName, l.JobPrefix) {
+		return false
+	}
+	if l.StartFrom > 0 && log.StartTime < l.StartFrom {
+		return false
+	}
+	if l.StartTo > 0 && log.StartTime >= l.StartTo {
+		return false
+	}
+	if l.Reason != "" && log.Reason != l.Reason {
+		return false
+	}
+	if l.Worker != "" && log.WorkerIP != l.Worker && log.Hostname != l.Worker {
+		return false
+	}
+	if l.Keyword == "" {
+		return true
+	}
+
+	// 与全文索引一致 包含任意一个关键词即可
+	text := strings.ToLower(log.OutPut + "\n" + log.Error)
+	for _, word := range strings.Fields(strings.ToLower(l.Keyword)) {
+		if strings.Contains(text, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// 在内存中按查询条件过滤 排序和分页
+func QueryLogs(logs []*JobLog, query *Log) (*LogPage, error) {
+	page := &LogPage{Logs: make([]*JobLog, 0)}
+
+	var cursorTime int64
+	var cursorID primitive.ObjectID
+	if query.Cursor != "" {
+		var err error
+		if cursorTime, cursorID, err = decodeLogCursor(query.Cursor); err != nil {
+			return page, err
+		}
+	}
+
+	var matched []*JobLog
+	for _, log := range logs {
+		if !query.Match(log) {
+			continue
+		}
+		page.Total++
+		if query.Cursor != "" && !logOlder(log, cursorTime, cursorID) {
+			continue
+		}
+		matched = append(matched, log)
+	}
+
+	// 按开始时间倒序 开始时间相同时按id倒序
+	sort.Slice(matched, func(i, j int) bool {
+		return logOlder(matched[j], matched[i].StartTime, matched[i].ID)
+	})
+
+	limit := query.PageSize()
+	if int64(len(matched)) > limit {
+		matched = matched[:limit]
+		page.NextCursor = EncodeLogCursor(matched[len(matched)-1])
+	}
+	page.Logs = append(page.Logs, matched...)
+	return page, nil
+}
+
+// 日志是否比(startTime, id)更旧  分页时排在它之后
+func logOlder(log *JobLog, startTime int64, id primitive.ObjectID) bool {
+	if log.StartTime != startTime {
+		return log.StartTime < startTime
+	}
+	return bytes.Compare(log.ID[:], id[:]) < 0
+}
@@ -0,0 +1,63 @@
+package common
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+)
+
+// 任务日志的存储
+type LogStore interface {
+	// 批量写入日志  日志的id在写入前已经生成 重复写入同一条日志不能产生多条记录
+	Append(logs []*JobLog) error
+	// 按条件分页查询日志 按开始时间倒序
+	Query(query *Log) (*LogPage, error)
+	// 删除任务开始时间早于startTime的日志 jobName为空表示所有任务  返回删除的条数
+	DeleteBefore(jobName string, startTime int64) (int64, error)
+	// 返回有日志的任务名
+	JobNames() ([]string, error)
+}
+
+type LogCfg struct {
+	Backend      string     `toml:"backend"`      // 日志存储 mongo / file / memory
+	SpoolDir     string     `toml:"spoolDir"`     // 日志存储不可用时的本地缓冲目录 为空表示不缓冲
+	SpoolMaxSize int64      `toml:"spoolMaxSize"` // 本地缓冲的大小上限 MB 0表示不限制
+	File         FileLogCfg `toml:"file"`
+}
+
+type FileLogCfg struct {
+	Dir     string `toml:"dir"`     // 日志文件目录
+	MaxSize int64  `toml:"maxSize"` // 单个日志文件的大小上限 MB 超过后写入新文件
+}
+
+func loadLogCfg(path string) (*LogCfg, error) {
+	cfg := &LogCfg{}
+	if _, err := toml.DecodeFile(path, cfg); err != nil {
+		return cfg, err
+	}
+
+	// 默认使用MongoDB 兼容之前的部署
+	if cfg.Backend == "" {
+		cfg.Backend = LOG_BACKEND_MONGO
+	}
+	return cfg, nil
+}
+
+// 按配置创建日志存储
+func NewLogStore(cfg *LogCfg, mongoPath string) (LogStore, error) {
+	switch cfg.Backend {
+	case LOG_BACKEND_MONGO:
+		mc := MongoDB
+		if mc == nil {
+			var err error
+			if mc, err = MongoConn(mongoPath); err != nil {
+				return nil, err
+			}
+		}
+		return &MongoLogStore{Mongo: mc}, nil
+	case LOG_BACKEND_FILE:
+		return NewFileLogStore(cfg.File.Dir, cfg.File.MaxSize*1024*1024)
+	case LOG_BACKEND_MEMORY:
+		return NewMemoryLogStore(), nil
+	}
+	return nil, fmt.Errorf("不支持的日志存储 : %s", cfg.Backend)
+}
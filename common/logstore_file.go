@@ -0,0 +1,265 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 保存在本地jsonl文件中的日志  单个文件超过大小上限后写入新文件
+// 查询时需要读取所有文件 适合日志量不大的单机部署
+type FileLogStore struct {
+	dir     string
+	maxSize int64 // 单个文件的大小上限 字节 0表示不限制
+
+	mutex sync.Mutex
+	file  *os.File // 正在写入的文件
+	seq   int64    // 正在写入的文件的序号
+	size  int64    // 正在写入的文件的大小
+}
+
+func NewFileLogStore(dir string, maxSize int64) (*FileLogStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("没有配置日志文件目录")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	f := &FileLogStore{dir: dir, maxSize: maxSize}
+	files, err := f.files()
+	if err != nil {
+		return nil, err
+	}
+	// 继续写入最后一个文件
+	if len(files) > 0 {
+		last := files[len(files)-1]
+		f.seq, _ = strconv.ParseInt(strings.TrimSuffix(filepath.Base(last), LOG_FILE_EXT), 10, 64)
+		if err := truncateTorn(last); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// 写入时进程崩溃会在文件末尾留下不完整的一行  截断到最后一个完整的行 之后的写入从新的一行开始
+func truncateTorn(name string) error {
+	file, err := os.OpenFile(name, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// 从末尾向前找最后一个换行符
+	size := info.Size()
+	buf := make([]byte, 64*1024)
+	valid := int64(0)
+	for end := size; end > 0; {
+		n := int64(len(buf))
+		if n > end {
+			n = end
+		}
+		if _, err := file.ReadAt(buf[:n], end-n); err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			valid = end - n + int64(i) + 1
+			break
+		}
+		end -= n
+	}
+
+	if valid == size {
+		return nil
+	}
+	fmt.Println("日志文件", name, " 末尾有不完整的一行 截断", size-valid, "字节")
+	return file.Truncate(valid)
+}
+
+// 按写入顺序返回所有的日志文件
+func (f *FileLogStore) files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(f.dir, "*"+LOG_FILE_EXT))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (f *FileLogStore) path(seq int64) string {
+	return filepath.Join(f.dir, fmt.Sprintf("%020d%s", seq, LOG_FILE_EXT))
+}
+
+// 打开正在写入的文件  超过大小上限时切换到新文件
+func (f *FileLogStore) open() error {
+	if f.file != nil && (f.maxSize <= 0 || f.size < f.maxSize) {
+		return nil
+	}
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+		f.seq++
+	}
+	if f.seq == 0 {
+		f.seq = 1
+	}
+
+	file, err := os.OpenFile(f.path(f.seq), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *FileLogStore) Append(logs []*JobLog) error {
+	var data []byte
+	for _, log := range logs {
+		line, err := json.Marshal(log)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.open(); err != nil {
+		return err
+	}
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return err
+}
+
+// 读取所有文件中的日志  同一条日志重复写入时只保留一条
+func (f *FileLogStore) readAll() ([]*JobLog, error) {
+	files, err := f.files()
+	if err != nil {
+		return nil, err
+	}
+
+	var logs []*JobLog
+	ids := make(map[string]bool)
+	for _, name := range files {
+		fileLogs, err := readLogFile(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, log := range fileLogs {
+			if ids[log.ID.Hex()] {
+				continue
+			}
+			ids[log.ID.Hex()] = true
+			logs = append(logs, log)
+		}
+	}
+	return logs, nil
+}
+
+func (f *FileLogStore) Query(query *Log) (*LogPage, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	logs, err := f.readAll()
+	if err != nil {
+		return &LogPage{Logs: make([]*JobLog, 0)}, err
+	}
+	return QueryLogs(logs, query)
+}
+
+// 重写包含过期日志的文件  文件中的日志全部过期时删除文件
+func (f *FileLogStore) DeleteBefore(jobName string, startTime int64) (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// 关闭正在写入的文件 下次写入时重新打开
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+
+	files, err := f.files()
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int64
+	for _, name := range files {
+		logs, err := readLogFile(name)
+		if err != nil {
+			return deleted, err
+		}
+
+		var data []byte
+		var removed int64
+		for _, log := range logs {
+			if (jobName == "" || log.JobName == jobName) && log.StartTime < startTime {
+				removed++
+				continue
+			}
+			line, err := json.Marshal(log)
+			if err != nil {
+				return deleted, err
+			}
+			data = append(append(data, line...), '\n')
+		}
+		if removed == 0 {
+			continue
+		}
+
+		if len(data) == 0 {
+			err = os.Remove(name)
+		} else {
+			err = replaceFile(name, data)
+		}
+		if err != nil {
+			return deleted, err
+		}
+		deleted += removed
+	}
+	return deleted, nil
+}
+
+func (f *FileLogStore) JobNames() ([]string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	logs, err := f.readAll()
+	if err != nil {
+		return nil, err
+	}
+	return logJobNames(logs), nil
+}
+
+// 先写临时文件再改名 替换文件的内容
+func replaceFile(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package common
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newTestLog(jobName string, startTime int64) *JobLog {
+	return &JobLog{ID: primitive.NewObjectID(), JobName: jobName, StartTime: startTime}
+}
+
+// 写入时进程崩溃留下的不完整的行 不影响查询 重新打开时被截断
+func TestFileLogStoreTornLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileLogStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append([]*JobLog{newTestLog("job1", 1), newTestLog("job2", 2)}); err != nil {
+		t.Fatal(err)
+	}
+	store.file.Close()
+
+	// 模拟写入一半时崩溃
+	file, err := os.OpenFile(store.path(1), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"id":"5e8c`)
+	file.Close()
+
+	page, err := (&FileLogStore{dir: dir}).Query(&Log{})
+	if err != nil {
+		t.Fatal("末尾不完整的行导致查询失败 : ", err)
+	}
+	if page.Total != 2 {
+		t.Fatalf("查询到%d条日志 期望2条", page.Total)
+	}
+
+	// 重新打开后继续写入 新的日志不会和不完整的行拼在一起
+	store, err = NewFileLogStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append([]*JobLog{newTestLog("job1", 3)}); err != nil {
+		t.Fatal(err)
+	}
+	page, err = store.Query(&Log{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 3 {
+		t.Fatalf("查询到%d条日志 期望3条", page.Total)
+	}
+	names, err := store.JobNames()
+	if err != nil || len(names) != 2 {
+		t.Fatalf("任务名 %v 出错 %v", names, err)
+	}
+	if deleted, err := store.DeleteBefore("job1", 2); err != nil || deleted != 1 {
+		t.Fatalf("删除了%d条日志 出错 %v", deleted, err)
+	}
+}
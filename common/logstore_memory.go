@@ -0,0 +1,78 @@
+package common
+
+import (
+	"sort"
+	"sync"
+)
+
+// 保存在内存中的日志  只用于测试和本地调试 进程退出后日志丢失
+type MemoryLogStore struct {
+	mutex sync.Mutex
+	logs  []*JobLog
+	ids   map[string]bool
+}
+
+func NewMemoryLogStore() *MemoryLogStore {
+	return &MemoryLogStore{ids: make(map[string]bool)}
+}
+
+func (m *MemoryLogStore) Append(logs []*JobLog) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, log := range logs {
+		if m.ids[log.ID.Hex()] {
+			continue
+		}
+		m.ids[log.ID.Hex()] = true
+		m.logs = append(m.logs, log)
+	}
+	return nil
+}
+
+func (m *MemoryLogStore) Query(query *Log) (*LogPage, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return QueryLogs(m.logs, query)
+}
+
+func (m *MemoryLogStore) DeleteBefore(jobName string, startTime int64) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	keep := m.logs[:0]
+	var deleted int64
+	for _, log := range m.logs {
+		if (jobName == "" || log.JobName == jobName) && log.StartTime < startTime {
+			delete(m.ids, log.ID.Hex())
+			deleted++
+			continue
+		}
+		keep = append(keep, log)
+	}
+	m.logs = keep
+	return deleted, nil
+}
+
+func (m *MemoryLogStore) JobNames() ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return logJobNames(m.logs), nil
+}
+
+// 日志中出现过的任务名
+func logJobNames(logs []*JobLog) []string {
+	set := make(map[string]bool)
+	for _, log := range logs {
+		set[log.JobName] = true
+	}
+
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,78 @@
+package common
+
+import "testing"
+
+// 按游标翻页 每页按开始时间倒序 翻完所有页不重复也不遗漏
+func TestMemoryLogStoreCursorPaging(t *testing.T) {
+	store := NewMemoryLogStore()
+
+	var logs []*JobLog
+	for i := int64(0); i < 25; i++ {
+		// 每两条日志的开始时间相同 按id区分先后
+		logs = append(logs, newTestLog("job1", 1000+i/2))
+	}
+	logs = append(logs, newTestLog("job2", 2000))
+	if err := store.Append(logs); err != nil {
+		t.Fatal(err)
+	}
+	// 重复写入的日志只保留一条
+	if err := store.Append(logs[:3]); err != nil {
+		t.Fatal(err)
+	}
+
+	query := &Log{JobName: "job1", Limit: 10}
+	seen := make(map[string]bool)
+	var pages int
+	var last *JobLog
+	for {
+		page, err := store.Query(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != 25 {
+			t.Fatalf("总数 %d 期望25", page.Total)
+		}
+		pages++
+
+		for _, log := range page.Logs {
+			if seen[log.ID.Hex()] {
+				t.Fatalf("日志 %s 重复出现", log.ID.Hex())
+			}
+			seen[log.ID.Hex()] = true
+			if last != nil && !logOlder(log, last.StartTime, last.ID) {
+				t.Fatalf("日志没有按开始时间倒序")
+			}
+			last = log
+		}
+
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+
+	if pages != 3 || len(seen) != 25 {
+		t.Fatalf("翻了%d页 得到%d条日志 期望3页25条", pages, len(seen))
+	}
+}
+
+func TestMemoryLogStoreInvalidCursor(t *testing.T) {
+	store := NewMemoryLogStore()
+	if _, err := store.Query(&Log{Cursor: "not a cursor"}); err != ERR_INVALID_CURSOR {
+		t.Fatalf("错误 %v 期望 %v", err, ERR_INVALID_CURSOR)
+	}
+}
+
+func TestMemoryLogStoreDeleteBefore(t *testing.T) {
+	store := NewMemoryLogStore()
+	store.Append([]*JobLog{newTestLog("job1", 1), newTestLog("job1", 3), newTestLog("job2", 1)})
+
+	deleted, err := store.DeleteBefore("job1", 2)
+	if err != nil || deleted != 1 {
+		t.Fatalf("删除了%d条日志 出错 %v", deleted, err)
+	}
+	page, _ := store.Query(&Log{})
+	if page.Total != 2 {
+		t.Fatalf("剩余%d条日志 期望2条", page.Total)
+	}
+}
@@ -0,0 +1,110 @@
+package common
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// 使用MongoDB的cron.log集合存储日志
+type MongoLogStore struct {
+	*Mongo
+}
+
+// 日志的id在写入前生成 重试时已经写入的日志会因为id重复被忽略
+func (m *MongoLogStore) Append(logs []*JobLog) error {
+	docs := make([]interface{}, 0, len(logs))
+	for _, log := range logs {
+		docs = append(docs, log)
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), LOG_WRITE_TIMEOUT*time.Second)
+	defer cancelFunc()
+
+	_, err := m.Collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err == nil {
+		return nil
+	}
+
+	bwe, ok := err.(mongo.BulkWriteException)
+	if !ok || bwe.WriteConcernError != nil || len(bwe.WriteErrors) == 0 {
+		return err
+	}
+	for _, we := range bwe.WriteErrors {
+		if we.Code != MONGO_DUPLICATE_KEY {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MongoLogStore) Query(query *Log) (*LogPage, error) {
+	page := &LogPage{Logs: make([]*JobLog, 0)}
+
+	filter, err := query.CursorFilter()
+	if err != nil {
+		return page, err
+	}
+
+	// 总数不受分页影响
+	page.Total, err = m.Collection.CountDocuments(context.TODO(), query.Filter())
+	if err != nil {
+		return page, err
+	}
+
+	// 多取一条 判断是否还有下一页
+	limit := query.PageSize() + 1
+	sort := bson.D{{Key: "startTime", Value: -1}, {Key: "_id", Value: -1}}
+	cursor, err := m.Collection.Find(context.TODO(), filter, &options.FindOptions{Limit: &limit, Sort: sort})
+	if err != nil {
+		return page, err
+	}
+	defer cursor.Close(context.TODO())
+
+	for cursor.Next(context.TODO()) {
+		jl := &JobLog{}
+		if err := cursor.Decode(jl); err != nil {
+			continue
+		}
+		page.Logs = append(page.Logs, jl)
+	}
+	if err := cursor.Err(); err != nil {
+		return page, err
+	}
+
+	if int64(len(page.Logs)) >= limit {
+		page.Logs = page.Logs[:limit-1]
+		page.NextCursor = EncodeLogCursor(page.Logs[len(page.Logs)-1])
+	}
+	return page, nil
+}
+
+func (m *MongoLogStore) DeleteBefore(jobName string, startTime int64) (int64, error) {
+	filter := bson.M{"startTime": bson.M{"$lt": startTime}}
+	if jobName != "" {
+		filter["jobName"] = jobName
+	}
+
+	delResp, err := m.Collection.DeleteMany(context.TODO(), filter)
+	if err != nil {
+		return 0, err
+	}
+	return delResp.DeletedCount, nil
+}
+
+func (m *MongoLogStore) JobNames() ([]string, error) {
+	values, err := m.Collection.Distinct(context.TODO(), "jobName", bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(values))
+	for _, v := range values {
+		if name, ok := v.(string); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
@@ -3,7 +3,7 @@ package main
 import "scheduler/common"
 
 func main()  {
-	common.InitMqCfg("conf/mq.toml")
+	common.InitMqCfg("conf/mq.toml", "master")
 	b := []byte("he he 1111")
 	common.Send(b)
 }
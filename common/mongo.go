@@ -2,6 +2,7 @@ package common
 
 import (
 	"github.com/BurntSushi/toml"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/net/context"
@@ -14,16 +15,14 @@ type MongoCfg struct {
 }
 
 type Mongo struct {
-	Client     *mongo.Client
-	Collection *mongo.Collection
+	Client       *mongo.Client
+	Collection   *mongo.Collection
+	WorkflowRuns *mongo.Collection // 工作流的运行记录
+	Alerts       *mongo.Collection // 告警记录
 }
 
-type JobFilter struct {
-	JobName string `bson:"jobName"`
-}
-
-type JobSort struct {
-	Sort int64 `bson:"sort"`
+type WorkflowRunFilter struct {
+	RunID string `bson:"runId"`
 }
 
 var MongoDB *Mongo
@@ -54,11 +53,63 @@ func MongoConn(path string) (*Mongo, error) {
 
 	m.Client = client
 	m.Collection = client.Database("cron").Collection("log")
+	m.WorkflowRuns = client.Database("cron").Collection("workflow_run")
+	m.Alerts = client.Database("cron").Collection("alert")
 
 	MongoDB = &Mongo{
-		Client:     client,
-		Collection: client.Database("cron").Collection("log"),
+		Client:       client,
+		Collection:   client.Database("cron").Collection("log"),
+		WorkflowRuns: client.Database("cron").Collection("workflow_run"),
+		Alerts:       client.Database("cron").Collection("alert"),
 	}
 
 	return m, nil
 }
+
+// 创建日志查询需要的索引  索引已经存在时不会重复创建
+func (m *Mongo) CreateLogIndexes() error {
+	byStartTime := bson.D{{Key: "startTime", Value: -1}, {Key: "_id", Value: -1}}
+	models := []mongo.IndexModel{
+		{Keys: byStartTime},
+		{Keys: append(bson.D{{Key: "jobName", Value: 1}}, byStartTime...)},
+		{Keys: append(bson.D{{Key: "reason", Value: 1}}, byStartTime...)},
+		{Keys: append(bson.D{{Key: "workerIp", Value: 1}}, byStartTime...)},
+		{Keys: append(bson.D{{Key: "hostname", Value: 1}}, byStartTime...)},
+		{Keys: bson.D{{Key: "outPut", Value: "text"}, {Key: "error", Value: "text"}}},
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFunc()
+	_, err := m.Collection.Indexes().CreateMany(ctx, models)
+	return err
+}
+
+// 按保留天数创建日志的TTL索引  days为0时删除TTL索引
+func (m *Mongo) EnsureLogTTL(days int64) error {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelFunc()
+
+	indexes := m.Collection.Indexes()
+	if days <= 0 {
+		indexes.DropOne(ctx, LOG_TTL_INDEX)
+		return nil
+	}
+
+	expire := int32(days * 24 * 3600)
+	_, err := indexes.CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "createdAt", Value: 1}},
+		Options: options.Index().SetName(LOG_TTL_INDEX).SetExpireAfterSeconds(expire),
+	})
+	if err == nil {
+		return nil
+	}
+
+	// 索引已经存在但保留时间不同 修改索引的过期时间
+	return m.Collection.Database().RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: m.Collection.Name()},
+		{Key: "index", Value: bson.D{
+			{Key: "name", Value: LOG_TTL_INDEX},
+			{Key: "expireAfterSeconds", Value: expire},
+		}},
+	}).Err()
+}
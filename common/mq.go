@@ -1,83 +1,151 @@
 package common
 
 import (
+	"context"
 	"fmt"
 	"github.com/BurntSushi/toml"
-	"github.com/streadway/amqp"
+	"time"
 )
 
-type Mq struct {
-	Url   string `toml:"url"`
-	Queue string `toml:"queue"`
+// 事件总线  告警以及之后的其他事件都通过它在节点之间传递
+type EventBus interface {
+	// 发布一条事件  返回nil表示事件已经被总线可靠地接收
+	Publish(topic string, body []byte) error
+	// 订阅一个主题  ctx结束时停止订阅并关闭返回的chan
+	// 每条事件处理完后需要调用Ack 调用Nack时按requeue决定重新投递还是放入死信队列
+	// 没有确认的事件在订阅结束后会重新投递给其他订阅方
+	Subscribe(ctx context.Context, topic string) (<-chan *Event, error)
+	Close() error
 }
 
-var mqcfg *Mq
+// 总线上的一条事件
+type Event struct {
+	Topic string
+	Body  []byte
 
-func InitMqCfg(path string) error {
-	mq := &Mq{}
-	_, err := toml.DecodeFile(path, mq)
+	ack  func() error
+	nack func(requeue bool) error
+}
 
-	mqcfg = &Mq{
-		Url:   mq.Url,
-		Queue: mq.Queue,
+// 确认事件已经处理完成
+func (e *Event) Ack() error {
+	if e.ack == nil {
+		return nil
 	}
-	return err
+	return e.ack()
 }
 
-func Send(body []byte) error {
-	// 连接到mq
-	conn, err := amqp.Dial(mqcfg.Url)
-	defer conn.Close()
-	if err != nil {
-		return err
+// 事件处理失败  requeue为true时重新投递 否则放入死信队列
+func (e *Event) Nack(requeue bool) error {
+	if e.nack == nil {
+		return nil
 	}
+	return e.nack(requeue)
+}
 
-	// 创建channel
-	ch, err := conn.Channel()
-	defer ch.Close()
-	if err != nil {
+type Mq struct {
+	Type  string `toml:"type"`  // 事件总线 amqp / etcd / memory
+	Url   string `toml:"url"`   // amqp的地址
+	Queue string `toml:"queue"` // 告警使用的主题
+}
+
+var mqcfg *Mq
+
+// 当前使用的事件总线
+var Bus EventBus
+
+// 等待发布的告警  由单独的协程发布 mq不可用时不会阻塞调度
+var sendChan chan []byte
+
+// role为master或worker  worker和leader不在同一个进程 不能使用进程内的事件总线
+func InitMqCfg(path, role string) error {
+	mq := &Mq{}
+	if _, err := toml.DecodeFile(path, mq); err != nil {
 		return err
 	}
-	queue, err := ch.QueueDeclare(mqcfg.Queue, false, false, false, false, nil)
+
+	// 默认使用amqp 兼容之前的部署
+	if mq.Type == "" {
+		mq.Type = MQ_TYPE_AMQP
+	}
+	if mq.Queue == "" {
+		mq.Queue = MQ_ALERT_TOPIC
+	}
+	if mq.Type == MQ_TYPE_MEMORY && role == "worker" {
+		return fmt.Errorf("worker不能使用进程内的事件总线 告警无法传递到leader : %s", mq.Type)
+	}
+
+	bus, err := NewEventBus(mq)
 	if err != nil {
 		return err
 	}
 
-	// 发送数据
-	err = ch.Publish("", queue.Name, false, false, amqp.Publishing{
-		ContentType: "",
-		Body:        body,
-	})
-
-	return err
+	// 队列参数和已经存在的队列不一致时 所有的发布和订阅都会失败  启动时直接报错
+	if amqpBus, ok := bus.(*AMQPBus); ok {
+		if err := amqpBus.CheckQueue(mq.Queue); err != nil {
+			bus.Close()
+			return err
+		}
+	}
+	mqcfg, Bus = mq, bus
+	sendChan = make(chan []byte, MQ_SEND_BUFFER)
+	go sendLoop()
+	return nil
 }
 
-func Receive() (<-chan amqp.Delivery, error) {
-	// 连接到mq
-	fmt.Println("mqcfg : ", mqcfg)
-	conn, err := amqp.Dial(mqcfg.Url)
-	defer conn.Close()
-	if err != nil {
-		return nil, err
+// 按配置创建事件总线
+func NewEventBus(cfg *Mq) (EventBus, error) {
+	switch cfg.Type {
+	case MQ_TYPE_AMQP:
+		return NewAMQPBus(cfg.Url), nil
+	case MQ_TYPE_ETCD:
+		return NewEtcdBus(), nil
+	case MQ_TYPE_MEMORY:
+		return NewMemoryBus(), nil
 	}
+	return nil, fmt.Errorf("不支持的事件总线 : %s", cfg.Type)
+}
 
-	// 创建channel
-	ch, err := conn.Channel()
-	defer ch.Close()
-	if err != nil {
-		return nil, err
+// 发送一条告警  只放入发送队列 队列满时丢弃
+func Send(body []byte) error {
+	select {
+	case sendChan <- body:
+		return nil
+	default:
+		fmt.Println("告警发送队列已满 丢弃告警 : ", string(body))
+		return ERR_ALERT_QUEUE_FULL
 	}
+}
 
-	queue, err := ch.QueueDeclare(mqcfg.Queue, false, false, false, false, nil)
-	if err != nil {
-		return nil, err
+// 按顺序把告警发布到事件总线
+func sendLoop() {
+	for body := range sendChan {
+		publishAlert(body)
 	}
+}
 
-	// 消费数据
-	msgs, err := ch.Consume(queue.Name, "", true, false, false, false, nil)
-	if err != nil {
-		return nil, err
+// 发布一条告警  失败时按退避时间重试 重试期间告警留在发送队列中 直到事件总线接收或者被关闭
+func publishAlert(body []byte) {
+	backoff := time.Second
+	for {
+		err := Bus.Publish(mqcfg.Queue, body)
+		if err == nil {
+			return
+		}
+		if err == ERR_EVENT_BUS_CLOSED {
+			fmt.Println("事件总线已关闭 丢弃告警 : ", string(body))
+			return
+		}
+
+		fmt.Println("发送告警出错", backoff, "后重试 : ", err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > MQ_MAX_BACKOFF*time.Second {
+			backoff = MQ_MAX_BACKOFF * time.Second
+		}
 	}
+}
 
-	return msgs, nil
+// 订阅告警
+func Receive(ctx context.Context) (<-chan *Event, error) {
+	return Bus.Subscribe(ctx, mqcfg.Queue)
 }
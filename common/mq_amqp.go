@@ -0,0 +1,280 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"github.com/streadway/amqp"
+	"sync"
+	"time"
+)
+
+// 基于amqp的事件总线  所有发布共用一个长连接 连接断开后自动重连
+// 发布时开启publisher confirm 收到broker的确认后才返回
+type AMQPBus struct {
+	url string
+
+	lock     sync.Mutex
+	conn     *amqp.Connection
+	ch       *amqp.Channel          // 发布使用的channel
+	confirms chan amqp.Confirmation // 发布确认
+	declared map[string]bool        // 已经声明过的队列
+	closed   bool
+}
+
+func NewAMQPBus(url string) *AMQPBus {
+	return &AMQPBus{url: url, declared: make(map[string]bool)}
+}
+
+// 返回可用的连接  连接断开时重新连接
+func (b *AMQPBus) connection() (*amqp.Connection, error) {
+	if b.closed {
+		return nil, ERR_EVENT_BUS_CLOSED
+	}
+	if b.conn != nil && !b.conn.IsClosed() {
+		return b.conn, nil
+	}
+
+	conn, err := amqp.Dial(b.url)
+	if err != nil {
+		return nil, err
+	}
+	b.conn, b.ch = conn, nil
+	b.declared = make(map[string]bool)
+	return conn, nil
+}
+
+// 返回发布使用的channel  channel在出错后会被broker关闭 需要重新创建
+func (b *AMQPBus) channel() (*amqp.Channel, error) {
+	conn, err := b.connection()
+	if err != nil {
+		return nil, err
+	}
+	if b.ch != nil {
+		return b.ch, nil
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	b.ch = ch
+	b.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	// channel被关闭后下次发布时重新创建
+	go func(closed chan *amqp.Error) {
+		<-closed
+		b.lock.Lock()
+		if b.ch == ch {
+			b.ch = nil
+		}
+		b.lock.Unlock()
+	}(ch.NotifyClose(make(chan *amqp.Error, 1)))
+	return ch, nil
+}
+
+func (b *AMQPBus) declare(ch *amqp.Channel, topic string) error {
+	if b.declared[topic] {
+		return nil
+	}
+	if err := declareQueue(ch, topic); err != nil {
+		return err
+	}
+	b.declared[topic] = true
+	return nil
+}
+
+// 声明持久化的队列  被拒绝并且不再重新投递的消息进入死信队列
+// 已经存在的非持久化队列需要先删除 否则声明会失败
+func declareQueue(ch *amqp.Channel, topic string) error {
+	dead := topic + MQ_DEAD_SUFFIX
+	if _, err := ch.QueueDeclare(dead, true, false, false, false, nil); err != nil {
+		return queueError(dead, err)
+	}
+	_, err := ch.QueueDeclare(topic, true, false, false, false, amqp.Table{
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": dead,
+	})
+	return queueError(topic, err)
+}
+
+// 同名的队列已经以不同的参数存在
+type queueMismatchError struct {
+	queue  string
+	reason string
+}
+
+func (e *queueMismatchError) Error() string {
+	return fmt.Sprintf("队列 %s 和RabbitMQ中已经存在的同名队列参数不一致 : %s\n"+
+		"之前的版本使用非持久化的队列 升级后需要先删除该队列 (rabbitmqctl delete_queue %s) 或者在mq.toml中配置新的队列名",
+		e.queue, e.reason, e.queue)
+}
+
+// broker返回PRECONDITION_FAILED时 返回说明如何迁移的错误
+func queueError(queue string, err error) error {
+	if e, ok := err.(*amqp.Error); ok && e.Code == amqp.PreconditionFailed {
+		return &queueMismatchError{queue: queue, reason: e.Reason}
+	}
+	return err
+}
+
+// 启动时检查队列能否按当前的参数声明  参数不一致时返回错误
+// 连接不上broker时只输出日志 之后发布和订阅时会自动重连
+func (b *AMQPBus) CheckQueue(topic string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	conn, err := b.connection()
+	if err != nil {
+		fmt.Println("连接mq出错 稍后自动重连 : ", err)
+		return nil
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		fmt.Println("创建mq channel出错 : ", err)
+		return nil
+	}
+	defer ch.Close()
+
+	err = declareQueue(ch, topic)
+	if _, mismatch := err.(*queueMismatchError); mismatch {
+		return err
+	}
+	if err != nil {
+		fmt.Println("声明mq队列出错 : ", err)
+	}
+	return nil
+}
+
+func (b *AMQPBus) Publish(topic string, body []byte) error {
+	// 发布和等待确认需要串行 确认按发布顺序返回
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	ch, err := b.channel()
+	if err != nil {
+		return err
+	}
+	if err := b.declare(ch, topic); err != nil {
+		return err
+	}
+
+	err = ch.Publish("", topic, false, false, amqp.Publishing{
+		DeliveryMode: amqp.Persistent,
+		Body:         body,
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case confirm, ok := <-b.confirms:
+		if !ok {
+			return fmt.Errorf("发布事件时连接断开")
+		}
+		if !confirm.Ack {
+			return fmt.Errorf("broker拒绝了事件")
+		}
+		return nil
+	case <-time.After(MQ_CONFIRM_TIMEOUT * time.Second):
+		// 超时之后的确认无法和发布对应 丢弃这个channel
+		b.ch.Close()
+		b.ch = nil
+		return fmt.Errorf("等待broker确认超时")
+	}
+}
+
+func (b *AMQPBus) Subscribe(ctx context.Context, topic string) (<-chan *Event, error) {
+	events := make(chan *Event)
+	go func() {
+		defer close(events)
+
+		// 连接断开后按退避时间重新订阅
+		backoff := time.Second
+		for ctx.Err() == nil {
+			if err := b.consume(ctx, topic, events); err != nil {
+				fmt.Println("订阅", topic, " 出错 : ", err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				if backoff *= 2; backoff > MQ_MAX_BACKOFF*time.Second {
+					backoff = MQ_MAX_BACKOFF * time.Second
+				}
+				continue
+			}
+			backoff = time.Second
+		}
+	}()
+	return events, nil
+}
+
+// 在单独的channel上消费一个队列  直到ctx结束或者channel被关闭
+func (b *AMQPBus) consume(ctx context.Context, topic string, events chan<- *Event) error {
+	b.lock.Lock()
+	conn, err := b.connection()
+	b.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if err := declareQueue(ch, topic); err != nil {
+		return err
+	}
+	// 限制没有确认的消息数 其余的消息留在队列中 leader切换时可以马上被新的leader消费
+	if err := ch.Qos(MQ_PREFETCH, 0, false); err != nil {
+		return err
+	}
+	msgs, err := ch.Consume(topic, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-msgs:
+			if !ok {
+				return fmt.Errorf("消费的channel被关闭")
+			}
+			event := &Event{
+				Topic: topic,
+				Body:  msg.Body,
+				ack: func() error {
+					return msg.Ack(false)
+				},
+				nack: func(requeue bool) error {
+					return msg.Nack(false, requeue)
+				},
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				// 没有交给订阅方的事件重新投递
+				msg.Nack(false, true)
+				return nil
+			}
+		}
+	}
+}
+
+func (b *AMQPBus) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.closed = true
+	if b.conn == nil {
+		return nil
+	}
+	return b.conn.Close()
+}
@@ -0,0 +1,114 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"github.com/coreos/etcd/clientv3"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 基于etcd的事件总线  每条事件保存为主题目录下的一个key 按key的顺序消费 确认后删除 拒绝后移到死信目录
+// 不需要额外部署mq 适合事件量不大的场景
+type EtcdBus struct {
+}
+
+func NewEtcdBus() *EtcdBus {
+	return &EtcdBus{}
+}
+
+func etcdBusDir(topic string) string {
+	return MQ_ETCD_DIR + topic + "/"
+}
+
+func (b *EtcdBus) Publish(topic string, body []byte) error {
+	// key按发布时间排序 加上随机数避免同一时间发布的事件冲突
+	key := fmt.Sprintf("%s%020d-%08x", etcdBusDir(topic), time.Now().UnixNano(), rand.Uint32())
+	_, err := ETCD.KV.Put(context.TODO(), key, string(body))
+	return err
+}
+
+func (b *EtcdBus) Subscribe(ctx context.Context, topic string) (<-chan *Event, error) {
+	events := make(chan *Event)
+	go func() {
+		defer close(events)
+
+		// 已经交给订阅方 还没有确认的事件
+		var lock sync.Mutex
+		inflight := make(map[string]bool)
+		done := func(key string) {
+			lock.Lock()
+			delete(inflight, key)
+			lock.Unlock()
+		}
+
+		dir := etcdBusDir(topic)
+		watchChan := ETCD.Client.Watch(ctx, dir, clientv3.WithPrefix(), clientv3.WithFilterDelete())
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			getResp, err := ETCD.KV.Get(ctx, dir, clientv3.WithPrefix(),
+				clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend), clientv3.WithLimit(MQ_ETCD_BATCH))
+			if err == nil {
+				for _, kv := range getResp.Kvs {
+					key, value := string(kv.Key), kv.Value
+					lock.Lock()
+					pending := inflight[key]
+					inflight[key] = true
+					lock.Unlock()
+					if pending {
+						continue
+					}
+
+					event := &Event{
+						Topic: topic,
+						Body:  value,
+						ack: func() error {
+							defer done(key)
+							_, err := ETCD.KV.Delete(context.TODO(), key)
+							return err
+						},
+						nack: func(requeue bool) error {
+							defer done(key)
+							if requeue {
+								return nil
+							}
+							// 移到死信目录
+							deadKey := etcdBusDir(topic+MQ_DEAD_SUFFIX) + strings.TrimPrefix(key, dir)
+							_, err := ETCD.KV.Txn(context.TODO()).
+								If(clientv3.Compare(clientv3.CreateRevision(key), ">", 0)).
+								Then(clientv3.OpDelete(key), clientv3.OpPut(deadKey, string(value))).
+								Commit()
+							return err
+						},
+					}
+					select {
+					case events <- event:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+
+			// 有新的事件或者定时检查被重新投递的事件
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-watchChan:
+				// watch被关闭后只靠定时检查
+				if !ok {
+					watchChan = nil
+				}
+			case <-ticker.C:
+			}
+		}
+	}()
+	return events, nil
+}
+
+func (b *EtcdBus) Close() error {
+	return nil
+}
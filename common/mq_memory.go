@@ -0,0 +1,84 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// 进程内的事件总线  只能在同一个进程内传递事件 用于单节点部署和测试
+type MemoryBus struct {
+	lock   sync.Mutex
+	topics map[string]chan *Event
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{topics: make(map[string]chan *Event)}
+}
+
+func (b *MemoryBus) topic(name string) chan *Event {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	ch, exist := b.topics[name]
+	if !exist {
+		ch = make(chan *Event, MQ_MEMORY_BUFFER)
+		b.topics[name] = ch
+	}
+	return ch
+}
+
+func (b *MemoryBus) Publish(topic string, body []byte) error {
+	return b.publish(&Event{Topic: topic, Body: body})
+}
+
+// 缓冲满时直接丢弃 不能阻塞发布方
+func (b *MemoryBus) publish(event *Event) error {
+	// 重新投递时使用同一个事件
+	event.nack = func(requeue bool) error {
+		if requeue {
+			return b.publish(event)
+		}
+		// 死信队列满了直接丢弃
+		select {
+		case b.topic(event.Topic + MQ_DEAD_SUFFIX) <- &Event{Topic: event.Topic + MQ_DEAD_SUFFIX, Body: event.Body}:
+		default:
+		}
+		return nil
+	}
+
+	select {
+	case b.topic(event.Topic) <- event:
+		return nil
+	default:
+		fmt.Println("事件总线", event.Topic, " 缓冲已满 丢弃事件")
+		return ERR_EVENT_BUS_FULL
+	}
+}
+
+func (b *MemoryBus) Subscribe(ctx context.Context, topic string) (<-chan *Event, error) {
+	events := make(chan *Event)
+	ch := b.topic(topic)
+	go func() {
+		defer close(events)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-ch:
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					// 没有交给订阅方的事件放回去
+					b.publish(event)
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+func (b *MemoryBus) Close() error {
+	return nil
+}
@@ -0,0 +1,203 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/go-gomail/gomail"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// 告警渠道
+type AlertNotifier interface {
+	Name() string
+	Notify(alert *AlertsInfo) error
+}
+
+// 一个告警渠道的配置  不同类型使用不同的字段
+type AlertChannelCfg struct {
+	Name string `toml:"name"` // 渠道名 用于区分同类型的多个渠道
+	Type string `toml:"type"` // smtp / webhook / slack / dingtalk / console
+
+	// smtp
+	Host     string   `toml:"host"`     // 邮箱host
+	Port     int      `toml:"port"`     // 邮箱端口
+	From     string   `toml:"from"`     // 发送邮件邮箱
+	Password string   `toml:"password"` // 密码 or 授权码 为空时不做认证
+	To       []string `toml:"to"`       // 接受邮件邮箱
+
+	// webhook slack dingtalk
+	URL      string            `toml:"url"`      // 接收告警的地址
+	Headers  map[string]string `toml:"headers"`  // 额外的请求头
+	Template string            `toml:"template"` // webhook的请求体模板 为空时发送告警的json
+	Timeout  int64             `toml:"timeout"`  // 请求超时时间 秒
+}
+
+// 按配置创建告警渠道
+func NewAlertNotifier(cfg *AlertChannelCfg) (AlertNotifier, error) {
+	if cfg.Name == "" {
+		cfg.Name = cfg.Type
+	}
+
+	switch cfg.Type {
+	case ALERT_CHANNEL_SMTP:
+		if cfg.Host == "" || cfg.From == "" || len(cfg.To) == 0 {
+			return nil, fmt.Errorf("告警渠道 %s 缺少邮箱配置", cfg.Name)
+		}
+		return &SMTPNotifier{cfg: cfg}, nil
+	case ALERT_CHANNEL_WEBHOOK:
+		tpl, err := parseAlertTemplate(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return newHTTPNotifier(cfg, func(alert *AlertsInfo) ([]byte, error) {
+			if tpl == nil {
+				return json.Marshal(alert)
+			}
+			var buf bytes.Buffer
+			err := tpl.Execute(&buf, alert)
+			return buf.Bytes(), err
+		})
+	case ALERT_CHANNEL_SLACK:
+		return newHTTPNotifier(cfg, func(alert *AlertsInfo) ([]byte, error) {
+			return json.Marshal(map[string]interface{}{"text": alert.Text()})
+		})
+	case ALERT_CHANNEL_DINGTALK:
+		return newHTTPNotifier(cfg, func(alert *AlertsInfo) ([]byte, error) {
+			return json.Marshal(map[string]interface{}{
+				"msgtype": "text",
+				"text":    map[string]string{"content": alert.Text()},
+			})
+		})
+	case ALERT_CHANNEL_CONSOLE:
+		return &ConsoleNotifier{name: cfg.Name}, nil
+	}
+	return nil, fmt.Errorf("不支持的告警渠道 : %s", cfg.Type)
+}
+
+// 模板中可以使用json函数输出转义后的json字符串
+func parseAlertTemplate(cfg *AlertChannelCfg) (*template.Template, error) {
+	if cfg.Template == "" {
+		return nil, nil
+	}
+	tpl, err := template.New(cfg.Name).Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}).Parse(cfg.Template)
+	if err != nil {
+		return nil, fmt.Errorf("告警渠道 %s 模板错误 : %s", cfg.Name, err)
+	}
+	return tpl, nil
+}
+
+// 通过邮件发送告警  每条告警使用单独的邮件
+type SMTPNotifier struct {
+	cfg *AlertChannelCfg
+}
+
+func (s *SMTPNotifier) Name() string {
+	return s.cfg.Name
+}
+
+func (s *SMTPNotifier) Notify(alert *AlertsInfo) error {
+	// 告警信息中带有任务的输出 需要转义后再放入html
+	body := "<h2> 告警类型 : " + html.EscapeString(alert.TypeName()) + "</h2>\n"
+	if alert.JobName != "" {
+		body += "<p>告警任务 : " + html.EscapeString(alert.JobName) + "</p>\n"
+	}
+	body += "<p>告警节点 : " + html.EscapeString(alert.Worker) + "</p>\n"
+	body += "<p>告警时间 : " + html.EscapeString(alert.Time) + "</p>\n"
+	body += "<p>告警信息 : " + html.EscapeString(alert.ErrorInfo) + "</p>\n"
+
+	msg := gomail.NewMessage()
+	msg.SetAddressHeader("From", s.cfg.From, "")
+	// 任务指定的收件人和渠道配置的收件人一起接收
+	msg.SetHeader("To", append(append([]string{}, s.cfg.To...), alert.Recipients...)...)
+	msg.SetHeader("Subject", alert.Title())
+	msg.SetBody("text/html", body)
+
+	dialer := &gomail.Dialer{Host: s.cfg.Host, Port: s.cfg.Port, SSL: s.cfg.Port == 465}
+	if s.cfg.Password != "" {
+		dialer.Username, dialer.Password = s.cfg.From, s.cfg.Password
+	}
+	return dialer.DialAndSend(msg)
+}
+
+// 通过http post发送告警  请求体由payload生成
+type HTTPNotifier struct {
+	cfg     *AlertChannelCfg
+	client  *http.Client
+	payload func(alert *AlertsInfo) ([]byte, error)
+}
+
+func newHTTPNotifier(cfg *AlertChannelCfg, payload func(alert *AlertsInfo) ([]byte, error)) (*HTTPNotifier, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("告警渠道 %s 缺少url", cfg.Name)
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = ALERT_HTTP_TIMEOUT
+	}
+	return &HTTPNotifier{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: time.Duration(timeout) * time.Second},
+		payload: payload,
+	}, nil
+}
+
+func (h *HTTPNotifier) Name() string {
+	return h.cfg.Name
+}
+
+func (h *HTTPNotifier) Notify(alert *AlertsInfo) error {
+	body, err := h.payload(alert)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range h.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("告警渠道 %s 返回 %d : %s", h.cfg.Name, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+// 输出到标准输出
+type ConsoleNotifier struct {
+	name string
+}
+
+func (c *ConsoleNotifier) Name() string {
+	return c.name
+}
+
+func (c *ConsoleNotifier) Notify(alert *AlertsInfo) error {
+	fmt.Println("************************ 告警信息 ************************")
+	fmt.Println()
+	fmt.Println(alert.Text())
+	fmt.Println()
+	fmt.Println("*********************************************************")
+	return nil
+}
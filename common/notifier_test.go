@@ -0,0 +1,247 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// 记录收到的请求的本地http服务
+type capturedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+func newCaptureServer(t *testing.T, status int) (*httptest.Server, chan *capturedRequest) {
+	requests := make(chan *capturedRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		requests <- &capturedRequest{header: r.Header, body: body}
+		w.WriteHeader(status)
+		w.Write([]byte("bad request"))
+	}))
+	return server, requests
+}
+
+func testAlert() *AlertsInfo {
+	return &AlertsInfo{
+		ID:        "5e8c1b2a3f4d5e6f7a8b9c0d",
+		JobName:   "job1",
+		Worker:    "192.168.1.10",
+		AlertType: ALERT_TYPE_FAILED,
+		ErrorInfo: "exit status 1",
+		Time:      "2020-04-01 10:00:00",
+	}
+}
+
+// 没有模板时发送告警的json 并带上配置的请求头
+func TestWebhookNotifier(t *testing.T) {
+	server, requests := newCaptureServer(t, http.StatusOK)
+	defer server.Close()
+
+	notifier, err := NewAlertNotifier(&AlertChannelCfg{
+		Type:    ALERT_CHANNEL_WEBHOOK,
+		URL:     server.URL,
+		Headers: map[string]string{"X-Token": "secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Notify(testAlert()); err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-requests
+	if req.header.Get("X-Token") != "secret" || req.header.Get("Content-Type") != "application/json" {
+		t.Errorf("请求头 %v", req.header)
+	}
+	alert := &AlertsInfo{}
+	if err := json.Unmarshal(req.body, alert); err != nil {
+		t.Fatal(err)
+	}
+	if alert.JobName != "job1" || alert.AlertType != ALERT_TYPE_FAILED {
+		t.Errorf("请求体 %s", req.body)
+	}
+}
+
+// 模板中的json函数输出转义后的字符串
+func TestWebhookNotifierTemplate(t *testing.T) {
+	server, requests := newCaptureServer(t, http.StatusOK)
+	defer server.Close()
+
+	notifier, err := NewAlertNotifier(&AlertChannelCfg{
+		Type:     ALERT_CHANNEL_WEBHOOK,
+		URL:      server.URL,
+		Template: `{"job": {{json .JobName}}, "error": {{json .ErrorInfo}}}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alert := testAlert()
+	alert.ErrorInfo = `line1 "quoted"` + "\nline2"
+	if err := notifier.Notify(alert); err != nil {
+		t.Fatal(err)
+	}
+
+	body := map[string]string{}
+	if err := json.Unmarshal((<-requests).body, &body); err != nil {
+		t.Fatal("模板生成的请求体不是合法的json : ", err)
+	}
+	if body["job"] != "job1" || body["error"] != alert.ErrorInfo {
+		t.Errorf("请求体 %v", body)
+	}
+}
+
+func TestSlackNotifier(t *testing.T) {
+	server, requests := newCaptureServer(t, http.StatusOK)
+	defer server.Close()
+
+	notifier, err := NewAlertNotifier(&AlertChannelCfg{Name: "ops", Type: ALERT_CHANNEL_SLACK, URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notifier.Name() != "ops" {
+		t.Errorf("渠道名 %s", notifier.Name())
+	}
+	if err := notifier.Notify(testAlert()); err != nil {
+		t.Fatal(err)
+	}
+
+	body := map[string]string{}
+	if err := json.Unmarshal((<-requests).body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(body["text"], "job1") || !strings.Contains(body["text"], "exit status 1") {
+		t.Errorf("消息内容 %q", body["text"])
+	}
+}
+
+// 非2xx的响应返回错误 错误中带上响应内容
+func TestHTTPNotifierErrorStatus(t *testing.T) {
+	server, requests := newCaptureServer(t, http.StatusBadRequest)
+	defer server.Close()
+
+	notifier, err := NewAlertNotifier(&AlertChannelCfg{Type: ALERT_CHANNEL_SLACK, URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = notifier.Notify(testAlert())
+	<-requests
+	if err == nil || !strings.Contains(err.Error(), "400") || !strings.Contains(err.Error(), "bad request") {
+		t.Fatalf("错误 %v", err)
+	}
+}
+
+func TestHTTPNotifierMissingURL(t *testing.T) {
+	if _, err := NewAlertNotifier(&AlertChannelCfg{Type: ALERT_CHANNEL_WEBHOOK}); err == nil {
+		t.Fatal("缺少url时应该返回错误")
+	}
+}
+
+// 收到的一封邮件
+type capturedMail struct {
+	recipients []string
+	data       []byte
+}
+
+// 只实现发送邮件需要的命令的本地smtp服务  不支持STARTTLS和认证
+func newSMTPServer(t *testing.T) (net.Listener, chan *capturedMail) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mails := make(chan *capturedMail, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		text := textproto.NewConn(conn)
+		text.PrintfLine("220 localhost ESMTP")
+		captured := &capturedMail{}
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(line); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				text.PrintfLine("250 localhost")
+			case strings.HasPrefix(cmd, "RCPT TO:"):
+				captured.recipients = append(captured.recipients, strings.Trim(line[len("RCPT TO:"):], "<> "))
+				text.PrintfLine("250 OK")
+			case cmd == "DATA":
+				text.PrintfLine("354 end with .")
+				if captured.data, err = text.ReadDotBytes(); err != nil {
+					return
+				}
+				mails <- captured
+				text.PrintfLine("250 OK")
+			case cmd == "QUIT":
+				text.PrintfLine("221 bye")
+				return
+			default:
+				text.PrintfLine("250 OK")
+			}
+		}
+	}()
+	return listener, mails
+}
+
+// 渠道配置的收件人和任务指定的收件人都收到邮件 告警内容转义后放入html
+func TestSMTPNotifier(t *testing.T) {
+	listener, mails := newSMTPServer(t)
+	defer listener.Close()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	notifier, err := NewAlertNotifier(&AlertChannelCfg{
+		Type: ALERT_CHANNEL_SMTP,
+		Host: addr.IP.String(),
+		Port: addr.Port,
+		From: "cron@example.com",
+		To:   []string{"ops@example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alert := testAlert()
+	alert.JobName = "<b>job1</b>"
+	alert.ErrorInfo = "<script>alert(1)</script> & exit status 1"
+	alert.Recipients = []string{"owner@example.com"}
+	if err := notifier.Notify(alert); err != nil {
+		t.Fatal(err)
+	}
+
+	captured := <-mails
+	if strings.Join(captured.recipients, ",") != "ops@example.com,owner@example.com" {
+		t.Errorf("收件人 %v", captured.recipients)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(captured.data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(body), "<script>") || strings.Contains(string(body), "<b>") {
+		t.Errorf("告警内容没有转义 : %s", body)
+	}
+	if !strings.Contains(string(body), "&lt;script&gt;alert(1)&lt;/script&gt; &amp; exit status 1") ||
+		!strings.Contains(string(body), "&lt;b&gt;job1&lt;/b&gt;") {
+		t.Errorf("邮件内容 %s", body)
+	}
+}
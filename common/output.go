@@ -0,0 +1,37 @@
+package common
+
+import "fmt"
+
+// 任务输出的一行
+type OutputLine struct {
+	Seq    int64  `json:"seq"`    // 行号 从1开始
+	Stream string `json:"stream"` // stdout / stderr
+	Text   string `json:"text"`   // 行内容 不包含换行符
+	Time   int64  `json:"time"`   // 输出时间 毫秒
+}
+
+// 正在执行的任务的输出  worker定期发布到etcd 每次只包含上次发布之后的新输出
+type JobOutput struct {
+	Name     string        `json:"name"`      // 任务名
+	Worker   string        `json:"worker"`    // 执行任务的worker
+	PlanTime int64         `json:"plan_time"` // 计划执行时间 毫秒
+	Attempt  int64         `json:"attempt"`   // 第几次执行
+	Seq      int64         `json:"seq"`       // 目前为止输出的总行数
+	Lines    []*OutputLine `json:"lines"`     // 上次发布之后的新输出
+	Done     bool          `json:"done"`      // 任务是否已经执行结束
+}
+
+// 任务一次执行的输出在etcd中的key
+func JobOutputKey(name string, planTime, attempt int64) string {
+	return fmt.Sprintf("%s%s/%d-%d", JOB_OUTPUT_DIR, name, planTime, attempt)
+}
+
+// 返回行号大于seq的输出
+func (o *JobOutput) After(seq int64) []*OutputLine {
+	for i, line := range o.Lines {
+		if line.Seq > seq {
+			return o.Lines[i:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"time"
+)
+
+// 日志保留策略  两个条件都设置时 超过任意一个的日志都会被清理
+type RetentionPolicy struct {
+	Days    int64 `json:"days" toml:"days"`         // 保留最近多少天的日志 0表示不限制
+	MaxRuns int64 `json:"max_runs" toml:"max_runs"` // 每个任务保留最近多少条日志 0表示不限制
+}
+
+type RetentionCfg struct {
+	RetentionPolicy
+	TTLDays    int64  `toml:"ttl_days"`    // TTL索引的保留天数 超过后由MongoDB直接删除 不会归档 0表示不使用TTL索引
+	Interval   int64  `toml:"interval"`    // 清理任务的执行间隔 秒
+	ArchiveDir string `toml:"archive_dir"` // 删除前把日志归档到这个目录 为空表示不归档
+}
+
+var Retention *RetentionCfg
+
+func InitRetentionCfg(path string) error {
+	cfg := &RetentionCfg{}
+	if _, err := toml.DecodeFile(path, cfg); err != nil {
+		return err
+	}
+
+	if cfg.Days < 0 || cfg.MaxRuns < 0 || cfg.TTLDays < 0 {
+		return fmt.Errorf("日志保留配置不能小于0")
+	}
+	// 需要归档时 TTL索引不能先于清理任务删除日志
+	if cfg.ArchiveDir != "" && cfg.TTLDays > 0 && cfg.Days > 0 && cfg.TTLDays <= cfg.Days {
+		return fmt.Errorf("归档日志时ttl_days(%d)必须大于days(%d)", cfg.TTLDays, cfg.Days)
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = RETENTION_INTERVAL
+	}
+
+	Retention = cfg
+	return nil
+}
+
+// 返回任务实际使用的保留策略  任务没有单独设置时使用全局配置
+func (c *RetentionCfg) Policy(job *RetentionPolicy) RetentionPolicy {
+	if job != nil {
+		return *job
+	}
+	return c.RetentionPolicy
+}
+
+// 检查任务单独设置的保留策略
+// MongoDB的TTL索引对所有任务生效  任务保留的天数超过ttl_days时日志会被直接删除 也不会归档
+func (c *RetentionCfg) CheckJob(job *RetentionPolicy) error {
+	if c == nil || job == nil || c.TTLDays <= 0 || Sink == nil {
+		return nil
+	}
+	if _, ok := Sink.Store.(*MongoLogStore); !ok {
+		return nil
+	}
+
+	if job.Days == 0 || job.Days > c.TTLDays {
+		return fmt.Errorf("使用TTL索引时保留天数必须设置并且不能超过ttl_days(%d)", c.TTLDays)
+	}
+	if c.ArchiveDir != "" && job.Days >= c.TTLDays {
+		return fmt.Errorf("归档日志时保留天数必须小于ttl_days(%d)", c.TTLDays)
+	}
+	return nil
+}
+
+// 日志清理的执行间隔
+func (c *RetentionCfg) Every() time.Duration {
+	return time.Duration(c.Interval) * time.Second
+}
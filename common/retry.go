@@ -0,0 +1,61 @@
+package common
+
+import "time"
+
+// 任务失败后的重试策略
+type RetryPolicy struct {
+	MaxAttempts      int64  `json:"max_attempts"`        // 最多执行次数(包含第一次)  <=1 表示不重试
+	Backoff          string `json:"backoff"`             // 退避方式 fixed / exponential
+	Interval         int64  `json:"interval"`            // 重试间隔 秒
+	MaxInterval      int64  `json:"max_interval"`        // 指数退避时的最大间隔 秒 0表示最多一天
+	RetryOnExitCodes []int  `json:"retry_on_exit_codes"` // 只有这些退出码才重试 为空表示任意失败都重试
+}
+
+// 返回任务最多执行的次数
+func (r *RetryPolicy) Attempts() int64 {
+	if r == nil || r.MaxAttempts < 1 {
+		return 1
+	}
+	return r.MaxAttempts
+}
+
+// 计算第attempt次执行失败后 下次重试前需要等待的时间
+func (r *RetryPolicy) Delay(attempt int64) time.Duration {
+	if r == nil || r.Interval <= 0 {
+		return 0
+	}
+
+	interval := time.Duration(r.Interval) * time.Second
+	if r.Backoff != RETRY_BACKOFF_EXPONENTIAL {
+		return interval
+	}
+
+	// 指数退避 interval * 2^(attempt-1)  不超过最大间隔
+	max := time.Duration(r.MaxInterval) * time.Second
+	if max <= 0 {
+		max = RETRY_MAX_DELAY * time.Second
+	}
+	for i := int64(1); i < attempt && interval < max; i++ {
+		interval *= 2
+	}
+	if interval > max {
+		return max
+	}
+	return interval
+}
+
+// 根据退出码判断任务是否需要重试
+func (r *RetryPolicy) ShouldRetry(exitCode int) bool {
+	if r == nil {
+		return false
+	}
+	if len(r.RetryOnExitCodes) == 0 {
+		return true
+	}
+	for _, code := range r.RetryOnExitCodes {
+		if code == exitCode {
+			return true
+		}
+	}
+	return false
+}
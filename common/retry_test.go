@@ -0,0 +1,52 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	cases := []struct {
+		name    string
+		policy  *RetryPolicy
+		attempt int64
+		want    time.Duration
+	}{
+		{"没有策略", nil, 1, 0},
+		{"没有间隔", &RetryPolicy{MaxAttempts: 3}, 2, 0},
+		{"固定间隔", &RetryPolicy{Interval: 5}, 1, 5 * time.Second},
+		{"固定间隔不随次数增长", &RetryPolicy{Interval: 5}, 4, 5 * time.Second},
+		{"指数退避第一次", &RetryPolicy{Backoff: RETRY_BACKOFF_EXPONENTIAL, Interval: 2}, 1, 2 * time.Second},
+		{"指数退避第三次", &RetryPolicy{Backoff: RETRY_BACKOFF_EXPONENTIAL, Interval: 2}, 3, 8 * time.Second},
+		{"指数退避达到上限", &RetryPolicy{Backoff: RETRY_BACKOFF_EXPONENTIAL, Interval: 2, MaxInterval: 5}, 3, 5 * time.Second},
+		{"间隔本身超过上限", &RetryPolicy{Backoff: RETRY_BACKOFF_EXPONENTIAL, Interval: 10, MaxInterval: 5}, 1, 5 * time.Second},
+		{"次数很多时不溢出", &RetryPolicy{Backoff: RETRY_BACKOFF_EXPONENTIAL, Interval: 1}, 100, RETRY_MAX_DELAY * time.Second},
+	}
+
+	for _, c := range cases {
+		if got := c.policy.Delay(c.attempt); got != c.want {
+			t.Errorf("%s : 第%d次失败后等待 %s 期望 %s", c.name, c.attempt, got, c.want)
+		}
+	}
+}
+
+func TestRetryPolicyAttempts(t *testing.T) {
+	var none *RetryPolicy
+	if none.Attempts() != 1 || (&RetryPolicy{MaxAttempts: 0}).Attempts() != 1 || (&RetryPolicy{MaxAttempts: 3}).Attempts() != 3 {
+		t.Fatal("执行次数错误")
+	}
+}
+
+func TestRetryPolicyShouldRetry(t *testing.T) {
+	var none *RetryPolicy
+	if none.ShouldRetry(1) {
+		t.Error("没有策略时不重试")
+	}
+	if !(&RetryPolicy{}).ShouldRetry(7) {
+		t.Error("没有指定退出码时任意失败都重试")
+	}
+	policy := &RetryPolicy{RetryOnExitCodes: []int{2, 75}}
+	if !policy.ShouldRetry(75) || policy.ShouldRetry(1) {
+		t.Error("只有指定的退出码才重试")
+	}
+}
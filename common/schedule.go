@@ -0,0 +1,55 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"github.com/coreos/etcd/clientv3"
+	"strconv"
+)
+
+// 任务最后一次被调度的时间保存在 /cron/last/任务名  值为补零的毫秒时间戳 可以直接按字符串比较大小
+func lastScheduleValue(t int64) string {
+	return fmt.Sprintf("%020d", t)
+}
+
+// 返回任务最后一次被调度的时间  毫秒
+func LastScheduleTime(jobName string) (int64, bool, error) {
+	getResp, err := ETCD.KV.Get(context.TODO(), JOB_LAST_DIR+jobName)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(getResp.Kvs) == 0 {
+		return 0, false, nil
+	}
+
+	t, err := strconv.ParseInt(string(getResp.Kvs[0].Value), 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return t, true, nil
+}
+
+// 记录任务最后一次被调度的时间  只会向后更新
+func SaveLastScheduleTime(jobName string, t int64) error {
+	key := JOB_LAST_DIR + jobName
+	value := lastScheduleValue(t)
+
+	txnResp, err := ETCD.KV.Txn(context.TODO()).
+		If(clientv3.Compare(clientv3.Value(key), "<", value)).
+		Then(clientv3.OpPut(key, value)).Commit()
+	if err != nil || txnResp.Succeeded {
+		return err
+	}
+
+	// key还不存在
+	_, err = ETCD.KV.Txn(context.TODO()).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, value)).Commit()
+	return err
+}
+
+// 删除任务的调度时间记录
+func DeleteLastScheduleTime(jobName string) error {
+	_, err := ETCD.KV.Delete(context.TODO(), JOB_LAST_DIR+jobName)
+	return err
+}
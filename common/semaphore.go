@@ -0,0 +1,138 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/coreos/etcd/clientv3"
+	"sort"
+	"time"
+)
+
+// 全局的命名信号量  同一时间最多有capacity个任务实例持有
+type Semaphore struct {
+	Name     string `json:"name"`     // 信号量名 如 order-db
+	Capacity int64  `json:"capacity"` // 同时持有的最大数目
+}
+
+// 持有或者等待信号量的任务实例
+type SemaphoreHolder struct {
+	JobName  string `json:"job_name"`  // 任务名
+	Worker   string `json:"worker"`    // 执行任务的worker
+	PlanTime int64  `json:"plan_time"` // 计划执行时间 毫秒
+	Since    int64  `json:"since"`     // 开始持有或者等待的时间 毫秒
+}
+
+func semaphoreSlotKey(name string, slot int64) string {
+	return fmt.Sprintf("%s%s/%d", SEMAPHORE_SLOT_DIR, name, slot)
+}
+
+func semaphoreWaitKey(name string, holder *SemaphoreHolder) string {
+	return fmt.Sprintf("%s%s/%s/%d", SEMAPHORE_WAIT_DIR, name, holder.JobName, holder.PlanTime)
+}
+
+// 读取信号量的定义
+func GetSemaphore(name string) (*Semaphore, error) {
+	getResp, err := ETCD.KV.Get(context.TODO(), SEMAPHORE_SAVE_DIR+name)
+	if err != nil {
+		return nil, err
+	}
+	if len(getResp.Kvs) == 0 {
+		return nil, ERR_SEMAPHORE_NOT_FOUND
+	}
+
+	sem := &Semaphore{}
+	if err := json.Unmarshal(getResp.Kvs[0].Value, sem); err != nil {
+		return nil, err
+	}
+	return sem, nil
+}
+
+// 用任务锁的租约获取任务需要的所有信号量  任务锁释放时信号量一起释放
+// 按名字顺序获取 避免两个任务互相等待  等待超过maxWait返回ERR_SEMAPHORE_TIMEOUT
+func (j *JobLock) AcquireSemaphores(ctx context.Context, names []string, maxWait time.Duration, holder *SemaphoreHolder) error {
+	names = append([]string{}, names...)
+	sort.Strings(names)
+
+	ctx, cancelFunc := context.WithTimeout(ctx, maxWait)
+	defer cancelFunc()
+
+	for _, name := range names {
+		if err := j.acquireSemaphore(ctx, name, holder); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 获取一个信号量  没有空闲的名额时登记为等待者 直到有名额释放
+func (j *JobLock) acquireSemaphore(ctx context.Context, name string, holder *SemaphoreHolder) error {
+	sem, err := GetSemaphore(name)
+	if err != nil {
+		return err
+	}
+
+	holder.Since = time.Now().UnixNano() / 1000000
+	value, err := json.Marshal(holder)
+	if err != nil {
+		return err
+	}
+
+	waitKey := semaphoreWaitKey(name, holder)
+	defer ETCD.KV.Delete(context.TODO(), waitKey)
+
+	waiting := false
+	for {
+		// 从名额中抢一个 watch从这次读取之后开始 不会漏掉名额的释放
+		revision, err := j.trySemaphore(sem, string(value))
+		if err != ERR_SEMAPHORE_FULL {
+			return err
+		}
+
+		// 登记为等待者 在状态接口中可以看到
+		if !waiting {
+			if _, err := ETCD.KV.Put(context.TODO(), waitKey, string(value), clientv3.WithLease(j.leaseID)); err != nil {
+				return err
+			}
+			waiting = true
+		}
+
+		watchCtx, watchCancel := context.WithCancel(ctx)
+		watchChan := ETCD.Client.Watch(watchCtx, SEMAPHORE_SLOT_DIR+name+"/", clientv3.WithPrefix(),
+			clientv3.WithRev(revision+1), clientv3.WithFilterPut())
+		select {
+		case <-watchChan:
+		case <-ctx.Done():
+		}
+		watchCancel()
+
+		if ctx.Err() == context.DeadlineExceeded {
+			return ERR_SEMAPHORE_TIMEOUT
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// 尝试抢一个名额  都被占用时返回ERR_SEMAPHORE_FULL和读取时的版本
+func (j *JobLock) trySemaphore(sem *Semaphore, value string) (int64, error) {
+	var revision int64
+	for i := int64(0); i < sem.Capacity; i++ {
+		key := semaphoreSlotKey(sem.Name, i)
+		txnResp, err := ETCD.KV.Txn(context.TODO()).
+			If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+			Then(clientv3.OpPut(key, value, clientv3.WithLease(j.leaseID))).
+			Commit()
+		if err != nil {
+			return 0, err
+		}
+		if txnResp.Succeeded {
+			return 0, nil
+		}
+		if i == 0 {
+			revision = txnResp.Header.Revision
+		}
+	}
+	return revision, ERR_SEMAPHORE_FULL
+}
@@ -0,0 +1,195 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 日志的本地磁盘缓冲  日志存储不可用时按批次写入文件 恢复后按写入顺序重放
+// 每个批次一个文件 文件名是递增的序号
+type LogSpool struct {
+	dir     string
+	maxSize int64 // 缓冲文件的总大小上限 字节 0表示不限制
+
+	mutex sync.Mutex
+	seq   int64 // 最后一个批次的序号
+	files []string
+	size  int64 // 缓冲文件的总大小
+	count int64 // 缓冲的日志条数
+
+	notify chan struct{}
+}
+
+// 打开缓冲目录  加载上次没有重放完的批次
+func OpenLogSpool(dir string, maxSize int64) (*LogSpool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &LogSpool{dir: dir, maxSize: maxSize, notify: make(chan struct{}, 1)}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"+LOG_FILE_EXT))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if seq, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(name), LOG_FILE_EXT), 10, 64); err == nil && seq > s.seq {
+			s.seq = seq
+		}
+		logs, err := readLogFile(name)
+		if err != nil {
+			fmt.Println("日志缓冲文件损坏 : ", name, err)
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		s.files = append(s.files, name)
+		s.size += info.Size()
+		s.count += int64(len(logs))
+	}
+
+	return s, nil
+}
+
+// 写入一个批次
+func (s *LogSpool) Append(logs []*JobLog) error {
+	var data []byte
+	for _, log := range logs {
+		line, err := json.Marshal(log)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.maxSize > 0 && s.size+int64(len(data)) > s.maxSize {
+		return ERR_LOG_SPOOL_FULL
+	}
+
+	// 先写临时文件再改名 避免重放时读到不完整的批次
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.seq+1, LOG_FILE_EXT))
+	if err := replaceFile(name, data); err != nil {
+		return err
+	}
+
+	s.seq++
+	s.files = append(s.files, name)
+	s.size += int64(len(data))
+	s.count += int64(len(logs))
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// 缓冲中是否还有没有重放的日志
+func (s *LogSpool) Empty() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.files) == 0
+}
+
+// 缓冲的日志条数
+func (s *LogSpool) Count() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.count
+}
+
+// 按写入顺序重放缓冲的批次  写入失败时退避重试
+func (s *LogSpool) Replay(write func([]*JobLog) error) {
+	backoff := time.Second
+	for {
+		s.mutex.Lock()
+		var name string
+		if len(s.files) > 0 {
+			name = s.files[0]
+		}
+		s.mutex.Unlock()
+
+		if name == "" {
+			<-s.notify
+			continue
+		}
+
+		logs, err := readLogFile(name)
+		if err == nil {
+			err = write(logs)
+		} else if os.IsNotExist(err) {
+			logs, err = nil, nil
+		} else {
+			// 文件损坏无法重放 跳过这个批次
+			fmt.Println("日志缓冲文件损坏 跳过 : ", name, err)
+			logs, err = nil, nil
+		}
+
+		if err != nil {
+			fmt.Println("重放缓冲的日志出错 ", backoff, "后重试 : ", err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > LOG_SPOOL_MAX_BACKOFF*time.Second {
+				backoff = LOG_SPOOL_MAX_BACKOFF * time.Second
+			}
+			continue
+		}
+		backoff = time.Second
+
+		info, _ := os.Stat(name)
+		os.Remove(name)
+
+		s.mutex.Lock()
+		s.files = s.files[1:]
+		if info != nil {
+			s.size -= info.Size()
+		}
+		s.count -= int64(len(logs))
+		s.mutex.Unlock()
+	}
+}
+
+func readLogFile(name string) ([]*JobLog, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var logs []*JobLog
+	var torn error
+	scanner := bufio.NewScanner(file)
+	// 日志中包含任务输出 单行可能很长
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		// 无法解析的不是最后一行 说明文件损坏
+		if torn != nil {
+			return nil, torn
+		}
+		log := &JobLog{}
+		if err := json.Unmarshal(scanner.Bytes(), log); err != nil {
+			torn = err
+			continue
+		}
+		logs = append(logs, log)
+	}
+
+	// 最后一行在写入时进程崩溃 只写入了一部分 跳过
+	if torn != nil {
+		fmt.Println("跳过日志文件", name, " 末尾不完整的一行 : ", torn)
+	}
+	return logs, scanner.Err()
+}
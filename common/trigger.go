@@ -0,0 +1,37 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// 任务的一次触发  定时调度或者手动触发
+type JobTrigger struct {
+	ID     string `json:"id"`     // 触发id 手动触发时由master生成 同一次触发在所有worker上相同
+	Name   string `json:"name"`   // 任务名
+	Type   string `json:"type"`   // 触发类型 cron / manual / workflow / misfire
+	User   string `json:"user"`   // 手动触发任务的用户
+	Time   int64  `json:"time"`   // 触发时间 毫秒  作为本次执行的计划执行时间
+	Worker string `json:"worker"` // 由leader分配任务时 执行任务的worker
+
+	WorkflowRunID string `json:"workflow_run_id"` // 由工作流触发时 工作流的运行id
+}
+
+// 是否为按cron表达式的定时调度  包括错过后的补执行
+func (t *JobTrigger) Scheduled() bool {
+	return t.Type == JOB_TRIGGER_CRON || t.Type == JOB_TRIGGER_MISFIRE
+}
+
+// 区分每次触发的标识  定时调度使用计划时间 其他触发使用触发id
+// 允许并发执行时 同一次触发只能被一个worker执行
+func (t *JobTrigger) TickID() string {
+	if t.ID != "" {
+		return t.ID
+	}
+	return strconv.FormatInt(t.Time, 10)
+}
+
+// 触发写入run目录的key  每次触发使用不同的key 同一任务的多次触发不会互相覆盖
+func JobRunKey(trigger *JobTrigger) string {
+	return fmt.Sprintf("%s%s/%s", JOB_RUN_DIR, trigger.Name, trigger.TickID())
+}
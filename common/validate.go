@@ -0,0 +1,36 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 请求参数中某个字段的错误
+type FieldError struct {
+	Field   string `json:"field"`   // 出错的字段名 与json中的字段名一致
+	Message string `json:"message"` // 错误原因
+}
+
+// 参数校验的错误列表  一次返回所有字段的错误
+type ValidationErrors []*FieldError
+
+// 添加一个字段错误
+func (v *ValidationErrors) Add(field, format string, args ...interface{}) {
+	*v = append(*v, &FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// 没有错误时返回nil 方便直接作为error返回
+func (v ValidationErrors) Err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(v))
+	for _, e := range v {
+		msgs = append(msgs, e.Field+" : "+e.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
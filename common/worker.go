@@ -0,0 +1,59 @@
+package common
+
+import (
+	"github.com/BurntSushi/toml"
+	"os"
+	"time"
+)
+
+// 程序版本 编译时可以通过 -ldflags "-X scheduler/common.Version=xxx" 指定
+var Version = "1.0.0"
+
+// worker节点的配置
+type WorkerCfg struct {
+	Labels   map[string]string `toml:"labels"`   // 节点标签
+	Capacity int64             `toml:"capacity"` // 同时执行任务的最大数目 0表示不限制
+}
+
+// 注册到etcd的worker节点信息
+type WorkerInfo struct {
+	IP        string            `json:"ip"`         // 节点ip
+	Hostname  string            `json:"hostname"`   // 主机名
+	Labels    map[string]string `json:"labels"`     // 节点标签 如 zone=a gpu=false
+	Capacity  int64             `json:"capacity"`   // 同时执行任务的最大数目 0表示不限制
+	Version   string            `json:"version"`    // 程序版本
+	StartTime int64             `json:"start_time"` // 启动时间 毫秒
+}
+
+// 根据配置文件生成本节点的信息
+func LoadWorkerInfo(path string) (*WorkerInfo, error) {
+	cfg := &WorkerCfg{}
+	if _, err := toml.DecodeFile(path, cfg); err != nil {
+		return nil, err
+	}
+
+	ip, err := GetLocalIP()
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+
+	return &WorkerInfo{
+		IP:        ip,
+		Hostname:  hostname,
+		Labels:    cfg.Labels,
+		Capacity:  cfg.Capacity,
+		Version:   Version,
+		StartTime: time.Now().UnixNano() / 1000000,
+	}, nil
+}
+
+// 判断节点标签是否满足任务的selector  selector为空时匹配所有节点
+func (w *WorkerInfo) Match(selector map[string]string) bool {
+	for k, v := range selector {
+		if w.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -2,9 +2,12 @@ package controller
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/astaxie/beego"
+	"io"
 	"scheduler/common"
 	. "scheduler/master"
+	"time"
 )
 
 type ApiController struct {
@@ -17,14 +20,55 @@ type Response struct {
 	Data    interface{} `json:"data"`
 }
 
+// 预览执行时间的请求
+type SchedulePreview struct {
+	CronExpr string `json:"cron_expr"`
+	Timezone string `json:"timezone"`
+	Count    int    `json:"count"`
+}
+
+// 预览的一次执行时间
+type PreviewTime struct {
+	Time  int64  `json:"time"`  // 执行时间 毫秒
+	Local string `json:"local"` // 在任务时区的本地时间
+}
+
+// 参数校验错误返回400和字段错误列表 其他错误返回500
+func errorResponse(err error) Response {
+	if errs, ok := err.(common.ValidationErrors); ok {
+		return Response{Code: 400, Message: err.Error(), Data: errs}
+	}
+	return Response{Code: 500, Message: err.Error()}
+}
+
+// 实时输出的一行 带有所属的执行
+type OutputEvent struct {
+	Worker   string `json:"worker"`
+	PlanTime int64  `json:"plan_time"`
+	Attempt  int64  `json:"attempt"`
+	*common.OutputLine
+}
+
+// 对任务的操作请求  记录发起操作的用户
+type JobAction struct {
+	Name string `json:"name"`
+	User string `json:"user"`
+}
+
 /*
 保存新增的job任务
+cron表达式的字段依次为 分 时 日 月 周  例子中的任务每小时整点执行
 
 {
 "name" : "job1",
 "command" : "echo hello",
-"cronExpr" : ""
+"cron_expr" : "0 * * * *",
+"timezone" : "Asia/Shanghai",
+"timeout" : 60
 }
+
+参数错误时返回400 data中是每个字段的错误
+[{"field" : "cron_expr", "message" : "..."}]
 */
 func (c *ApiController) Save() {
 	var job Job
@@ -36,7 +80,7 @@ func (c *ApiController) Save() {
 	}
 
 	if oldJob, err := job.SaveJob(); err != nil {
-		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.Data["json"] = errorResponse(err)
 		c.ServeJSON()
 		return
 	} else {
@@ -45,6 +89,44 @@ func (c *ApiController) Save() {
 	}
 }
 
+/*
+预览cron表达式接下来的执行时间
+例子预览纽约时间每天2:30的执行时间
+
+{
+"cron_expr" : "30 2 * * *",
+"timezone" : "America/New_York",
+"count" : 5
+}
+*/
+func (c *ApiController) PreviewJob() {
+	var preview SchedulePreview
+
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &preview); err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	times, err := PreviewSchedule(preview.CronExpr, preview.Timezone, preview.Count)
+	if err != nil {
+		c.Data["json"] = errorResponse(err)
+		c.ServeJSON()
+		return
+	}
+
+	list := make([]*PreviewTime, 0, len(times))
+	for _, t := range times {
+		list = append(list, &PreviewTime{
+			Time:  t.UnixNano() / 1000000,
+			Local: t.Format(common.TIME_FORMAT + " MST"),
+		})
+	}
+
+	c.Data["json"] = Response{Code: 200, Message: "success", Data: list}
+	c.ServeJSON()
+}
+
 /*
 删除任务
 
@@ -112,12 +194,114 @@ func (c *ApiController) KillJob() {
 }
 
 /*
-查询任务的执行日志
+立即执行一次任务
 
 {
-"jobName" : "",
-"skip" : 1,
-"limit" : 2
+"name" : "job1",
+"user" : "admin"
+}
+*/
+func (c *ApiController) RunJob() {
+	action, err := c.jobAction()
+	if err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	job := Job{Name: action.Name}
+	if err := job.RunJob(action.User); err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.Data["json"] = Response{Code: 200, Message: "success"}
+	c.ServeJSON()
+}
+
+/*
+暂停任务
+
+{
+"name" : "job1",
+"user" : "admin"
+}
+*/
+func (c *ApiController) PauseJob() {
+	action, err := c.jobAction()
+	if err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	job := Job{Name: action.Name}
+	paused, err := job.PauseJob(action.User)
+	if err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.Data["json"] = Response{Code: 200, Message: "success", Data: paused}
+	c.ServeJSON()
+}
+
+/*
+恢复被暂停的任务
+
+{
+"name" : "job1",
+"user" : "admin"
+}
+*/
+func (c *ApiController) ResumeJob() {
+	action, err := c.jobAction()
+	if err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	job := Job{Name: action.Name}
+	resumed, err := job.ResumeJob(action.User)
+	if err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.Data["json"] = Response{Code: 200, Message: "success", Data: resumed}
+	c.ServeJSON()
+}
+
+// 解析对任务的操作请求  没有传入用户时记录请求方的ip
+func (c *ApiController) jobAction() (*JobAction, error) {
+	action := &JobAction{}
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, action); err != nil {
+		return nil, err
+	}
+
+	if action.User == "" {
+		action.User = c.Ctx.Input.IP()
+	}
+	return action, nil
+}
+
+/*
+查询任务的执行日志  按开始时间倒序 下一页传入上一页返回的nextCursor
+
+{
+"jobName" : "job1",
+"jobPrefix" : "",
+"startFrom" : 1585000000000,
+"startTo" : 1586000000000,
+"reason" : "failed",
+"worker" : "192.168.1.10",
+"keyword" : "error",
+"cursor" : "",
+"limit" : 10
 }
 */
 func (c *ApiController) JobLog() {
@@ -129,22 +313,189 @@ func (c *ApiController) JobLog() {
 		return
 	}
 
-	if log.Skip == 0 {
-		log.Skip = 10
+	if log.Limit <= 0 {
+		log.Limit = common.LOG_PAGE_SIZE
 	}
-	if log.Limit == 0 {
-		log.Limit = 10
+	if log.Limit > common.LOG_MAX_PAGE_SIZE {
+		log.Limit = common.LOG_MAX_PAGE_SIZE
 	}
 
 	//查询日志
-	jobLog, err := JobLogs(&log)
+	page, err := JobLogs(&log)
+	if err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.Data["json"] = Response{Code: 200, Message: "success", Data: page}
+	c.ServeJSON()
+}
+
+/*
+实时查看正在执行的任务的输出  server-sent events
+
+GET /job/log/stream?name=job1
+
+event: line  每行输出
+event: done  一次执行结束
+*/
+func (c *ApiController) StreamJobLog() {
+	name := c.GetString("name")
+	if name == "" {
+		c.Data["json"] = Response{Code: 500, Message: "任务名不能为空"}
+		c.ServeJSON()
+		return
+	}
+
+	c.EnableRender = false
+	w := c.Ctx.ResponseWriter
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	w.Flush()
+
+	// 客户端断开连接时停止读取
+	ctx := c.Ctx.Request.Context()
+	err := WatchJobOutput(ctx, name, func(output *common.JobOutput, lines []*common.OutputLine) error {
+		for _, line := range lines {
+			if err := writeEvent(w, "line", &OutputEvent{output.Worker, output.PlanTime, output.Attempt, line}); err != nil {
+				return err
+			}
+		}
+		if output.Done {
+			if err := writeEvent(w, "done", &OutputEvent{output.Worker, output.PlanTime, output.Attempt, nil}); err != nil {
+				return err
+			}
+		}
+		w.Flush()
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		writeEvent(w, "error", err.Error())
+		w.Flush()
+	}
+}
+
+// 写入一个server-sent event
+func writeEvent(w io.Writer, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
+
+// master的日志写入统计
+func (c *ApiController) LogStats() {
+	if common.Sink == nil {
+		c.Data["json"] = Response{Code: 500, Message: "日志存储没有初始化"}
+		c.ServeJSON()
+		return
+	}
+
+	c.Data["json"] = Response{Code: 200, Message: "success", Data: common.Sink.Stats()}
+	c.ServeJSON()
+}
+
+// 向所有的告警渠道发送一条测试告警  只有负责告警的leader可以发送
+func (c *ApiController) TestAlert() {
+	if common.Alerter == nil {
+		c.Data["json"] = Response{Code: 500, Message: "本节点没有初始化告警"}
+		c.ServeJSON()
+		return
+	}
+
+	alert := &common.AlertsInfo{
+		Worker:    c.Ctx.Input.IP(),
+		AlertType: common.ALERT_TYPE_FAILED,
+		ErrorInfo: "测试告警",
+		Time:      time.Now().Format(common.TIME_FORMAT),
+	}
+	c.Data["json"] = Response{Code: 200, Message: "success", Data: common.Alerter.Test(alert)}
+	c.ServeJSON()
+}
+
+/*
+查询告警记录  按时间倒序 下一页传入上一页返回的nextCursor
+
+/alert/list?jobName=job1&worker=192.168.1.10&alertType=2&acked=false&startFrom=1585000000000&startTo=1586000000000&cursor=&limit=10
+*/
+func (c *ApiController) AlertList() {
+	query := &common.AlertQuery{
+		JobName: c.GetString("jobName"),
+		Worker:  c.GetString("worker"),
+		Cursor:  c.GetString("cursor"),
+	}
+	query.AlertType, _ = c.GetInt64("alertType")
+	query.StartFrom, _ = c.GetInt64("startFrom")
+	query.StartTo, _ = c.GetInt64("startTo")
+	query.Limit, _ = c.GetInt64("limit")
+	if acked, err := c.GetBool("acked"); err == nil && c.GetString("acked") != "" {
+		query.Acked = &acked
+	}
+
+	page, err := common.QueryAlerts(query)
+	if err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.Data["json"] = Response{Code: 200, Message: "success", Data: page}
+	c.ServeJSON()
+}
+
+// 确认告警的请求  没有传入用户时记录请求方的ip
+type AlertAck struct {
+	ID   string `json:"id"`
+	User string `json:"user"`
+}
+
+/*
+标记告警已经处理
+
+{
+"id" : "5e8c...",
+"user" : "admin"
+}
+*/
+func (c *ApiController) AckAlert() {
+	var ack AlertAck
+
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &ack); err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+	if ack.User == "" {
+		ack.User = c.Ctx.Input.IP()
+	}
+
+	record, err := common.AckAlert(ack.ID, ack.User)
+	if err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.Data["json"] = Response{Code: 200, Message: "success", Data: record}
+	c.ServeJSON()
+}
+
+// 当前的leader和任期
+func (c *ApiController) ClusterLeader() {
+	leader, err := common.CurrentLeader()
 	if err != nil {
 		c.Data["json"] = Response{Code: 500, Message: err.Error()}
 		c.ServeJSON()
 		return
 	}
 
-	c.Data["json"] = Response{Code: 200, Message: "success", Data: jobLog}
+	c.Data["json"] = Response{Code: 200, Message: "success", Data: leader}
 	c.ServeJSON()
 }
 
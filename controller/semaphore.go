@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"encoding/json"
+	"scheduler/common"
+	. "scheduler/master"
+)
+
+/*
+保存信号量
+
+{
+"name" : "order-db",
+"capacity" : 3
+}
+*/
+func (c *ApiController) SaveSemaphore() {
+	var sem common.Semaphore
+
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &sem); err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	old, err := SaveSemaphore(&sem)
+	if err != nil {
+		c.Data["json"] = errorResponse(err)
+		c.ServeJSON()
+		return
+	}
+
+	c.Data["json"] = Response{Code: 200, Message: "success", Data: old}
+	c.ServeJSON()
+}
+
+/*
+删除信号量
+
+{
+"name" : "order-db"
+}
+*/
+func (c *ApiController) DeleteSemaphore() {
+	var sem common.Semaphore
+
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &sem); err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	old, err := DeleteSemaphore(sem.Name)
+	if err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.Data["json"] = Response{Code: 200, Message: "success", Data: old}
+	c.ServeJSON()
+}
+
+// 返回所有信号量的状态 包括持有名额和排队等待的任务
+func (c *ApiController) SemaphoreList() {
+	list, err := SemaphoreList()
+	if err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.Data["json"] = Response{Code: 200, Message: "success", Data: list}
+	c.ServeJSON()
+}
@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"encoding/json"
+	. "scheduler/master"
+)
+
+/*
+保存工作流
+
+{
+"name" : "etl",
+"cron_expr" : "0 0 2 * * * *",
+"edges" : [
+{"from" : "extract", "to" : "transform", "condition" : "success"},
+{"from" : "transform", "to" : "load", "condition" : "success"}
+]
+}
+*/
+func (c *ApiController) SaveWorkflow() {
+	var workflow Workflow
+
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &workflow); err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	old, err := workflow.SaveWorkflow()
+	if err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.Data["json"] = Response{Code: 200, Message: "success", Data: old}
+	c.ServeJSON()
+}
+
+/*
+删除工作流
+
+{
+"name" : "etl"
+}
+*/
+func (c *ApiController) DeleteWorkflow() {
+	var workflow Workflow
+
+	if err := json.Unmarshal(c.Ctx.Input.RequestBody, &workflow); err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	old, err := workflow.DeleteWorkflow()
+	if err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.Data["json"] = Response{Code: 200, Message: "success", Data: old}
+	c.ServeJSON()
+}
+
+// 返回所有的工作流
+func (c *ApiController) WorkflowList() {
+	workflows, err := WorkflowList()
+	if err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.Data["json"] = Response{Code: 200, Message: "success", Data: workflows}
+	c.ServeJSON()
+}
+
+/*
+手动触发一次工作流  返回本次运行的信息
+
+{
+"name" : "etl",
+"user" : "admin"
+}
+*/
+func (c *ApiController) RunWorkflow() {
+	action, err := c.jobAction()
+	if err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	workflow := Workflow{Name: action.Name}
+	run, err := workflow.RunWorkflow(action.User)
+	if err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.Data["json"] = Response{Code: 200, Message: "success", Data: run}
+	c.ServeJSON()
+}
+
+// 查询工作流的运行状态  /workflow/status?runId=xxx
+func (c *ApiController) WorkflowStatus() {
+	run, err := WorkflowRunStatus(c.GetString("runId"))
+	if err != nil {
+		c.Data["json"] = Response{Code: 500, Message: err.Error()}
+		c.ServeJSON()
+		return
+	}
+
+	c.Data["json"] = Response{Code: 200, Message: "success", Data: run}
+	c.ServeJSON()
+}
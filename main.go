@@ -6,6 +6,7 @@ import (
 	"github.com/astaxie/beego"
 	"runtime"
 	"scheduler/common"
+	"scheduler/master"
 	_ "scheduler/router"
 )
 
@@ -17,14 +18,18 @@ var etcdConfig = flag.String("e", "conf/etcd.toml", "etcd配置文件路径")
 var mongoConfig = flag.String("m", "conf/mongo.toml", "mongo配置文件路径")
 var alertConfig = flag.String("a", "conf/alert.toml", "alert配置文件路径")
 var mqConfig = flag.String("mq", "conf/mq.toml", "mq配置文件路径")
+var dispatchConfig = flag.String("d", "conf/dispatch.toml", "任务分配配置文件路径")
+var retentionConfig = flag.String("r", "conf/retention.toml", "日志保留配置文件路径")
+var logConfig = flag.String("l", "conf/log.toml", "日志存储配置文件路径")
 
 func main() {
 	flag.Parse()
 
 	initEnv()
 
-	// 初始化mq
-	if err := common.InitMqCfg(*mqConfig); err != nil {
+	// 初始化事件总线
+	if err := common.InitMqCfg(*mqConfig, "master"); err != nil {
+		fmt.Println("初始化事件总线出错 : ", err)
 		return
 	}
 
@@ -34,25 +39,75 @@ func main() {
 		return
 	}
 
-	if err := common.InitLeader(); err != nil {
-		// 抢锁失败成为follower
-		fmt.Println("成为follower")
-		go common.WatchMaster(*alertConfig)
-	} else {
-		// 抢锁成功成为leader
-		// 负责告警操作
-		fmt.Println("成为leader")
-		go common.WatchMaster(*alertConfig)
+	// 初始化任务分配方式
+	if err := common.InitDispatchCfg(*dispatchConfig); err != nil {
+		fmt.Println("初始化加载任务分配配置出错 : ", err)
+		return
+	}
+
+	// 读取告警渠道 保存任务时检查任务指定的渠道
+	if err := common.InitAlertChannels(*alertConfig); err != nil {
+		fmt.Println("读取告警渠道配置出错 : ", err)
+	}
+
+	// leader负责告警操作  失去leader时交给新的leader
+	common.OnLeaderGain(func() {
 		if err := common.InitAlert(*alertConfig); err != nil {
 			fmt.Println("初始化alert出错 : ", err)
-			return
 		}
+	})
+	common.OnLeaderLoss(common.StopAlerts)
+
+	// 初始化MongoDB 保存工作流的运行记录和告警记录
+	if mongo, err := common.MongoConn(*mongoConfig); err != nil {
+		fmt.Println("初始化加载MongoDB配置出错")
+	} else if err := mongo.CreateAlertIndexes(); err != nil {
+		fmt.Println("创建告警索引出错 : ", err)
+	}
+
+	// 初始化日志存储
+	if err := common.InitLogSink(*logConfig, *mongoConfig, "master"); err != nil {
+		fmt.Println("初始化日志存储出错 : ", err)
 	}
 
+	// 初始化日志保留策略
+	if err := common.InitRetentionCfg(*retentionConfig); err != nil {
+		fmt.Println("初始化日志保留配置出错 : ", err)
+	}
 
-	// 初始化MongoDB
-	if err := common.InitLogSink(*mongoConfig); err != nil {
-		fmt.Println("初始化加载MongoDB配置出错")
+	// 日志存储在MongoDB时 创建查询索引和TTL索引
+	if common.Sink != nil {
+		if store, ok := common.Sink.Store.(*common.MongoLogStore); ok {
+			if err := store.CreateLogIndexes(); err != nil {
+				fmt.Println("创建日志索引出错 : ", err)
+			}
+			if common.Retention != nil {
+				if err := store.EnsureLogTTL(common.Retention.TTLDays); err != nil {
+					fmt.Println("创建日志TTL索引出错 : ", err)
+				}
+			}
+		}
+	}
+
+	// 初始化任务分配器 dispatch模式下由leader分配任务
+	if err := master.InitDispatcher(); err != nil {
+		fmt.Println("初始化任务分配器出错 : ", err)
+		return
+	}
+
+	// 初始化工作流引擎
+	master.InitWorkflowEngine()
+
+	// 初始化错过执行的检查
+	master.InitMisfireChecker()
+
+	// 初始化过期日志的清理
+	master.InitRetention()
+
+	// 注册完只在leader上运行的任务后 开始参加leader选举
+	if err := common.InitLeader(); err != nil {
+		fmt.Println("参加leader选举出错 : ", err)
+		return
 	}
 
 	beego.Run()
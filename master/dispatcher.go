@@ -0,0 +1,220 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"scheduler/common"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 由leader计算到期的任务 并分配给worker执行
+type Dispatcher struct {
+	JobEventChan chan *DispatchEvent      // etcd的任务变化
+	JobPlanMap   map[string]*DispatchPlan // 任务调度计划列表
+	leading      int32                    // 是否在分配任务 成为leader时开始 失去leader时停止
+}
+
+// 任务的调度计划
+type DispatchPlan struct {
+	Job      *Job                 // 任务信息
+	CronExpr *common.CronSchedule // 解析好的cron表达式 带有时区
+	NextTime time.Time            // 任务下次的执行时间
+}
+
+// 任务保存或删除事件  删除时job只有任务名
+type DispatchEvent struct {
+	eventType int64
+	job       *Job
+}
+
+var Dispatch *Dispatcher
+
+// 初始化任务分配器 只有在dispatch模式下才启动
+func InitDispatcher() error {
+	if !common.IsDispatchMode() {
+		return nil
+	}
+
+	Dispatch = &Dispatcher{
+		JobEventChan: make(chan *DispatchEvent, 1000),
+		JobPlanMap:   make(map[string]*DispatchPlan),
+	}
+
+	// 只有leader分配任务
+	common.OnLeaderGain(func() {
+		atomic.StoreInt32(&Dispatch.leading, 1)
+	})
+	common.OnLeaderLoss(func() {
+		atomic.StoreInt32(&Dispatch.leading, 0)
+	})
+
+	// 先启动调度协程 再把etcd中的任务推给它
+	go Dispatch.dispatchLoop()
+
+	return Dispatch.watchJobs()
+}
+
+// 从etcd获取全量任务 并监听任务的变化
+func (d *Dispatcher) watchJobs() error {
+	getResp, err := common.ETCD.KV.Get(context.TODO(), common.JOB_SAVE_DIR, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+
+	for _, v := range getResp.Kvs {
+		job := &Job{}
+		if err := json.Unmarshal(v.Value, job); err != nil {
+			continue
+		}
+		d.JobEventChan <- &DispatchEvent{eventType: common.JOB_EVENT_SAVE, job: job}
+	}
+
+	go func() {
+		// 从get时刻的版本向后监听变化
+		watchStartRevision := getResp.Header.Revision + 1
+		watchChan := clientv3.NewWatcher(common.ETCD.Client).Watch(context.TODO(), common.JOB_SAVE_DIR,
+			clientv3.WithPrefix(), clientv3.WithRev(watchStartRevision))
+
+		for watchResp := range watchChan {
+			for _, event := range watchResp.Events {
+				switch event.Type {
+				case mvccpb.PUT:
+					job := &Job{}
+					if err := json.Unmarshal(event.Kv.Value, job); err != nil {
+						continue
+					}
+					d.JobEventChan <- &DispatchEvent{eventType: common.JOB_EVENT_SAVE, job: job}
+				case mvccpb.DELETE:
+					job := &Job{Name: common.ExtractName(string(event.Kv.Key), common.JOB_SAVE_DIR)}
+					d.JobEventChan <- &DispatchEvent{eventType: common.JOB_EVENT_DELETE, job: job}
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// 调度协程  所有master都维护调度计划 只有leader分配任务
+func (d *Dispatcher) dispatchLoop() {
+	timer := time.NewTimer(d.tryDispatch())
+
+	for {
+		select {
+		case event := <-d.JobEventChan:
+			d.handleJobEvent(event)
+		case <-timer.C:
+		}
+
+		timer.Reset(d.tryDispatch())
+	}
+}
+
+func (d *Dispatcher) handleJobEvent(event *DispatchEvent) {
+	switch event.eventType {
+	case common.JOB_EVENT_SAVE:
+		// 暂停的任务不参与调度
+		if event.job.Paused {
+			delete(d.JobPlanMap, event.job.Name)
+			return
+		}
+
+		expr, err := common.ParseCron(event.job.CronExpr, event.job.Timezone)
+		if err != nil {
+			fmt.Println("任务", event.job.Name, " cron表达式解析出错 : ", err)
+			return
+		}
+		d.JobPlanMap[event.job.Name] = &DispatchPlan{
+			Job:      event.job,
+			CronExpr: expr,
+			NextTime: expr.Next(time.Now()),
+		}
+	case common.JOB_EVENT_DELETE:
+		delete(d.JobPlanMap, event.job.Name)
+	}
+}
+
+// 分配到期的任务 并返回距离最近一个任务到期的时间
+func (d *Dispatcher) tryDispatch() time.Duration {
+	now := time.Now()
+	var nearTime *time.Time
+
+	if len(d.JobPlanMap) == 0 {
+		return time.Second
+	}
+
+	for _, plan := range d.JobPlanMap {
+		if plan.NextTime.Before(now) || plan.NextTime.Equal(now) {
+			// follower只计算下次执行时间  保证成为leader后可以直接接管
+			if atomic.LoadInt32(&d.leading) == 1 {
+				trigger := &common.JobTrigger{
+					Name: plan.Job.Name,
+					Type: common.JOB_TRIGGER_CRON,
+					Time: plan.NextTime.UnixNano() / 1000000,
+				}
+				if err := AssignJob(trigger, plan.Job.Selector); err != nil {
+					fmt.Println("任务", plan.Job.Name, " 分配失败 : ", err)
+				}
+			}
+			plan.NextTime = plan.CronExpr.Next(now)
+		}
+
+		if nearTime == nil || plan.NextTime.Before(*nearTime) {
+			nearTime = &plan.NextTime
+		}
+	}
+
+	return (*nearTime).Sub(now)
+}
+
+// 把任务分配给满足selector并且当前未完成任务最少的worker
+func AssignJob(trigger *common.JobTrigger, selector map[string]string) error {
+	workers, err := WorkerList()
+	if err != nil {
+		return err
+	}
+
+	// 统计每个worker上已分配但还没有执行完的任务数
+	getResp, err := common.ETCD.KV.Get(context.TODO(), common.JOB_ASSIGN_DIR, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return err
+	}
+	load := make(map[string]int64)
+	for _, kv := range getResp.Kvs {
+		worker := strings.SplitN(common.ExtractName(string(kv.Key), common.JOB_ASSIGN_DIR), "/", 2)[0]
+		load[worker]++
+	}
+
+	trigger.Worker = ""
+	for _, worker := range workers {
+		// 标签不匹配 或者已经达到最大任务数的worker不参与分配
+		if !worker.Match(selector) || (worker.Capacity > 0 && load[worker.IP] >= worker.Capacity) {
+			continue
+		}
+		if trigger.Worker == "" || load[worker.IP] < load[trigger.Worker] {
+			trigger.Worker = worker.IP
+		}
+	}
+	if trigger.Worker == "" {
+		return common.ERR_NO_WORKER_AVAILABLE
+	}
+
+	value, err := json.Marshal(trigger)
+	if err != nil {
+		return err
+	}
+
+	// 分配记录带有租约 worker没有执行就挂掉时自动过期
+	leaseGrant, err := common.ETCD.Lease.Grant(context.TODO(), common.JOB_ASSIGN_TTL)
+	if err != nil {
+		return err
+	}
+
+	_, err = common.ETCD.KV.Put(context.TODO(), common.JobAssignKey(trigger), string(value), clientv3.WithLease(leaseGrant.ID))
+	return err
+}
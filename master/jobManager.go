@@ -5,39 +5,214 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/coreos/etcd/clientv3"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"scheduler/common"
+	"strings"
+	"time"
 )
 
 type Job struct {
-	Name     string `json:"name"`      // 任务名
-	Command  string `json:"command"`   // shell命令
-	CronExpr string `json:"cron_expr"` //cron表达式
-	Timeout  int64  `json:"timeout"`   // 任务执行的超时时间 秒
+	Name              string                  `json:"name"`               // 任务名
+	Command           string                  `json:"command"`            // shell命令
+	CronExpr          string                  `json:"cron_expr"`          //cron表达式
+	Timezone          string                  `json:"timezone"`           // cron表达式使用的时区 IANA名称 如Asia/Shanghai 为空表示worker本地时区
+	Timeout           int64                   `json:"timeout"`            // 任务执行的超时时间 秒
+	Retry             *common.RetryPolicy     `json:"retry"`              // 任务失败后的重试策略
+	ConcurrencyPolicy string                  `json:"concurrency_policy"` // 并发策略 Forbid(默认) / Allow / Replace
+	MaxConcurrency    int64                   `json:"max_concurrency"`    // Allow策略下最多同时执行的实例数 0表示不限制
+	LockLostPolicy    string                  `json:"lock_lost_policy"`   // 执行期间任务锁丢失的处理 mark(默认) 继续执行并记为lock_lost / kill 杀死任务
+	Semaphores        []string                `json:"semaphores"`         // 执行前需要获取的信号量 所有名额被占用时等待
+	SemaphoreWait     int64                   `json:"semaphore_wait"`     // 等待信号量的最长时间 秒 超时后记为跳过 0表示默认300秒
+	Selector          map[string]string       `json:"selector"`           // 只在标签匹配的worker上执行 为空表示所有worker
+	Labels            map[string]string       `json:"labels"`             // 任务标签 用于告警路由 如 team=billing
+	Alert             *common.AlertPolicy     `json:"alert"`              // 任务的告警配置 为空时失败 超时 被杀死告警
+	MisfirePolicy     string                  `json:"misfire_policy"`     // 错过执行后的处理策略 skip(默认) / run_once / run_all
+	MisfireLimit      int64                   `json:"misfire_limit"`      // run_all策略下最多补执行的次数 默认10
+	Retention         *common.RetentionPolicy `json:"retention"`          // 任务日志的保留策略 为空时使用全局配置
+	Paused            bool                    `json:"paused"`             // 任务是否被暂停 暂停的任务不会被调度
+	PausedAt          int64                   `json:"paused_at"`          // 任务被暂停的时间 毫秒
+	PausedBy          string                  `json:"paused_by"`          // 暂停任务的用户
 }
 
-//保存任务到etcd
+// 从etcd读取一个任务 同时返回任务的修改版本
+func getJob(name string) (*Job, int64, error) {
+	getResp, err := common.ETCD.KV.Get(context.TODO(), common.JOB_SAVE_DIR+name)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(getResp.Kvs) == 0 {
+		return nil, 0, common.ERR_JOB_NOT_FOUND
+	}
+
+	job := &Job{}
+	if err := json.Unmarshal(getResp.Kvs[0].Value, job); err != nil {
+		return nil, 0, err
+	}
+	return job, getResp.Kvs[0].ModRevision, nil
+}
+
+// 检查任务定义  返回common.ValidationErrors
+func (j *Job) Validate() error {
+	var errs common.ValidationErrors
+
+	if j.Name == "" {
+		errs.Add("name", "任务名不能为空")
+	} else if strings.Contains(j.Name, "/") {
+		errs.Add("name", "任务名不能包含'/'")
+	}
+	if strings.TrimSpace(j.Command) == "" {
+		errs.Add("command", "shell命令不能为空")
+	}
+
+	if _, err := common.LoadLocation(j.Timezone); err != nil {
+		errs.Add("timezone", "%s", err)
+	} else if j.CronExpr == "" {
+		errs.Add("cron_expr", "cron表达式不能为空")
+	} else if _, err := common.ParseCron(j.CronExpr, j.Timezone); err != nil {
+		errs.Add("cron_expr", "cron表达式错误 : %s", err)
+	}
+
+	if j.Timeout < 0 {
+		errs.Add("timeout", "超时时间不能小于0")
+	}
+
+	switch j.ConcurrencyPolicy {
+	case "", common.CONCURRENCY_FORBID, common.CONCURRENCY_ALLOW, common.CONCURRENCY_REPLACE:
+	default:
+		errs.Add("concurrency_policy", "不支持的并发策略 : %s", j.ConcurrencyPolicy)
+	}
+	if j.MaxConcurrency < 0 {
+		errs.Add("max_concurrency", "最大并发数不能小于0")
+	}
+
+	switch j.LockLostPolicy {
+	case "", common.LOCK_LOST_MARK, common.LOCK_LOST_KILL:
+	default:
+		errs.Add("lock_lost_policy", "不支持的锁丢失处理策略 : %s", j.LockLostPolicy)
+	}
+
+	for _, name := range j.Semaphores {
+		if name == "" || strings.Contains(name, "/") {
+			errs.Add("semaphores", "信号量名不能为空或者包含'/' : %s", name)
+		}
+	}
+	if j.SemaphoreWait < 0 {
+		errs.Add("semaphore_wait", "等待信号量的时间不能小于0")
+	}
+
+	switch j.MisfirePolicy {
+	case "", common.MISFIRE_SKIP, common.MISFIRE_RUN_ONCE, common.MISFIRE_RUN_ALL:
+	default:
+		errs.Add("misfire_policy", "不支持的错过执行策略 : %s", j.MisfirePolicy)
+	}
+	if j.MisfireLimit < 0 {
+		errs.Add("misfire_limit", "补执行次数不能小于0")
+	}
+
+	if j.Retention != nil && (j.Retention.Days < 0 || j.Retention.MaxRuns < 0) {
+		errs.Add("retention", "日志保留配置不能小于0")
+	} else if err := common.Retention.CheckJob(j.Retention); err != nil {
+		errs.Add("retention.days", "%s", err)
+	}
+
+	if j.Alert != nil {
+		for _, event := range j.Alert.Events {
+			if !common.ValidAlertEvent(event) {
+				errs.Add("alert.events", "不支持的告警事件 : %s", event)
+			}
+		}
+		for _, name := range j.Alert.Channels {
+			if !common.AlertChannelExists(name) {
+				errs.Add("alert.channels", "告警渠道不存在 : %s", name)
+			}
+		}
+		if j.Alert.LongRunning < 0 {
+			errs.Add("alert.long_running", "执行时间告警阈值不能小于0")
+		}
+	}
+
+	if j.Retry != nil {
+		switch j.Retry.Backoff {
+		case "", common.RETRY_BACKOFF_FIXED, common.RETRY_BACKOFF_EXPONENTIAL:
+		default:
+			errs.Add("retry.backoff", "不支持的退避方式 : %s", j.Retry.Backoff)
+		}
+		if j.Retry.Interval < 0 || j.Retry.MaxInterval < 0 {
+			errs.Add("retry.interval", "重试间隔不能小于0")
+		}
+	}
+
+	return errs.Err()
+}
+
+// 预览cron表达式在指定时区从现在开始的count次执行时间
+func PreviewSchedule(cronExpr, timezone string, count int) ([]time.Time, error) {
+	var errs common.ValidationErrors
+	if count <= 0 {
+		count = common.PREVIEW_DEFAULT_COUNT
+	} else if count > common.PREVIEW_MAX_COUNT {
+		errs.Add("count", "最多预览%d次", common.PREVIEW_MAX_COUNT)
+	}
+
+	schedule, err := common.ParseCron(cronExpr, timezone)
+	if _, locErr := common.LoadLocation(timezone); locErr != nil {
+		errs.Add("timezone", "%s", locErr)
+	} else if err != nil {
+		errs.Add("cron_expr", "cron表达式错误 : %s", err)
+	}
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+
+	return schedule.NextN(time.Now(), count), nil
+}
+
+// 保存任务到etcd
 func (j *Job) SaveJob() (*Job, error) {
 	job := &Job{}
 	// 得到任务在etcd的保存目录
 	jobKey := fmt.Sprintf("%s%s", common.JOB_SAVE_DIR, j.Name)
 
+	// 检查任务的各个字段 一次返回所有错误
+	if err := j.Validate(); err != nil {
+		return job, err
+	}
+
+	// 暂停状态只能通过pause/resume修改 保存任务时保留原来的暂停状态
+	old, revision, err := getJob(j.Name)
+	switch err {
+	case nil:
+		j.Paused, j.PausedAt, j.PausedBy = old.Paused, old.PausedAt, old.PausedBy
+	case common.ERR_JOB_NOT_FOUND:
+	default:
+		return job, err
+	}
+
 	// 对任务进行json序列化
 	jobValue, err := json.Marshal(j)
 	if err != nil {
 		return job, err
 	}
 
-	// 保存到etcd
-	putResp, err := common.ETCD.KV.Put(context.TODO(), jobKey, string(jobValue), clientv3.WithPrevKV())
+	// 只有在读取之后任务没有被修改过才写入 避免覆盖同时进行的暂停或恢复
+	// 新建任务时revision为0 要求key不存在
+	txnResp, err := common.ETCD.KV.Txn(context.TODO()).
+		If(clientv3.Compare(clientv3.ModRevision(jobKey), "=", revision)).
+		Then(clientv3.OpPut(jobKey, string(jobValue))).Commit()
 	if err != nil {
 		return job, err
 	}
+	if !txnResp.Succeeded {
+		return job, common.ERR_JOB_MODIFIED
+	}
 
 	// 如果是更新操作则返回原来的job
-	if putResp.PrevKv != nil {
-		json.Unmarshal(putResp.PrevKv.Value, job)
+	if old != nil {
+		job = old
 	}
+
+	// 修改任务后从当前时间开始判断是否错过执行
+	common.SaveLastScheduleTime(j.Name, time.Now().UnixNano()/1000000)
 	return job, nil
 }
 
@@ -56,13 +231,15 @@ func (j *Job) DeleteJob() (*Job, error) {
 	if len(delResp.PrevKvs) > 0 {
 		json.Unmarshal(delResp.PrevKvs[0].Value, job)
 	}
+
+	common.DeleteLastScheduleTime(j.Name)
 	return job, nil
 }
 
 // kill一个正在运行的任务
 func (j *Job) KillJob() error {
 	// 在kill目录put一个值  让worker监听这个目录
-	delKey := fmt.Sprintf("%s%s", common.JOB_DELETE_DIR, j.Name)
+	delKey := fmt.Sprintf("%s%s", common.JOB_KILL_DIR, j.Name)
 
 	// 创建一个租约让key自动过期
 	leaseGrant, err := common.ETCD.Lease.Grant(context.TODO(), 1)
@@ -76,6 +253,105 @@ func (j *Job) KillJob() error {
 	return nil
 }
 
+// 手动触发一次任务 不受cron表达式的限制
+func (j *Job) RunJob(user string) error {
+	// 任务必须已经保存 并且没有被暂停
+	job, _, err := getJob(j.Name)
+	if err != nil {
+		return err
+	}
+	if job.Paused {
+		return common.ERR_JOB_PAUSED
+	}
+
+	return job.fire(&common.JobTrigger{
+		Name: j.Name,
+		Type: common.JOB_TRIGGER_MANUAL,
+		User: user,
+		Time: time.Now().UnixNano() / 1000000,
+	})
+}
+
+// 触发一次任务执行  不检查任务是否被暂停
+// 不是定时调度的触发生成唯一的触发id  同一秒内的多次手动触发不会互相冲突
+func (j *Job) fire(trigger *common.JobTrigger) error {
+	if !trigger.Scheduled() && trigger.ID == "" {
+		trigger.ID = primitive.NewObjectID().Hex()
+	}
+
+	// 由leader分配任务时 直接分配给一个worker
+	if common.IsDispatchMode() {
+		return AssignJob(trigger, j.Selector)
+	}
+
+	// 在run目录put一个值  让worker监听这个目录
+	runKey := common.JobRunKey(trigger)
+	value, err := json.Marshal(trigger)
+	if err != nil {
+		return err
+	}
+
+	// 创建一个租约让key自动过期
+	leaseGrant, err := common.ETCD.Lease.Grant(context.TODO(), 1)
+	if err != nil {
+		return err
+	}
+
+	if _, err := common.ETCD.KV.Put(context.TODO(), runKey, string(value), clientv3.WithLease(leaseGrant.ID)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 暂停任务 任务定义保留但不再被调度
+func (j *Job) PauseJob(user string) (*Job, error) {
+	return j.setPaused(true, user)
+}
+
+// 恢复被暂停的任务
+func (j *Job) ResumeJob(user string) (*Job, error) {
+	return j.setPaused(false, user)
+}
+
+// 修改任务的暂停状态 并返回修改后的任务
+func (j *Job) setPaused(paused bool, user string) (*Job, error) {
+	job, revision, err := getJob(j.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	job.Paused = paused
+	job.PausedAt = 0
+	job.PausedBy = ""
+	if paused {
+		job.PausedAt = time.Now().UnixNano() / 1000000
+		job.PausedBy = user
+	}
+
+	jobValue, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+
+	// 只有在读取之后任务没有被修改过才写入 避免覆盖其他人的修改
+	jobKey := fmt.Sprintf("%s%s", common.JOB_SAVE_DIR, j.Name)
+	txnResp, err := common.ETCD.KV.Txn(context.TODO()).
+		If(clientv3.Compare(clientv3.ModRevision(jobKey), "=", revision)).
+		Then(clientv3.OpPut(jobKey, string(jobValue))).Commit()
+	if err != nil {
+		return nil, err
+	}
+	if !txnResp.Succeeded {
+		return nil, common.ERR_JOB_MODIFIED
+	}
+
+	// 暂停期间不算错过执行 恢复后从当前时间开始判断
+	if !paused {
+		common.SaveLastScheduleTime(j.Name, time.Now().UnixNano()/1000000)
+	}
+	return job, nil
+}
+
 // 返回所有的任务
 func (j *Job) JobList() (jobs []*Job, err error) {
 	getResp, err := common.ETCD.KV.Get(context.TODO(), common.JOB_SAVE_DIR, clientv3.WithPrefix())
@@ -95,30 +371,10 @@ func (j *Job) JobList() (jobs []*Job, err error) {
 	return
 }
 
-// 返回任务的执行日志
-func JobLogs(log *common.Log) (*[]common.JobLog, error) {
-	var logs = make([]common.JobLog, 0)
-
-	// 过滤条件
-	filter := common.JobFilter{JobName: log.JobName}
-	// 排序规则
-	sort := common.JobSort{Sort: -1}
-	skip := log.Skip
-	limit := log.Limit
-
-	cursor, err := common.MongoDB.Collection.Find(context.TODO(), filter, &options.FindOptions{Skip: &skip, Limit: &limit, Sort: sort})
-	defer cursor.Close(context.TODO())
-	if err != nil {
-		return &logs, err
+// 按条件查询任务的执行日志 按开始时间倒序分页
+func JobLogs(log *common.Log) (*common.LogPage, error) {
+	if common.Sink == nil {
+		return nil, common.ERR_LOG_STORE_UNAVAILABLE
 	}
-
-	for cursor.Next(context.TODO()) {
-		jl := common.JobLog{}
-		if err := cursor.Decode(&jl); err != nil {
-			continue
-		}
-		logs = append(logs, jl)
-	}
-
-	return &logs, nil
+	return common.Sink.Store.Query(log)
 }
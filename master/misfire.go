@@ -0,0 +1,141 @@
+package master
+
+import (
+	"context"
+	"fmt"
+	"scheduler/common"
+	"time"
+)
+
+// 初始化错过执行的检查  只有leader负责检查
+// 所有worker都挂掉时没有人记录调度时间  恢复后由leader按任务的策略补执行或者记录错过的执行
+func InitMisfireChecker() {
+	common.RunAsLeader(func(ctx context.Context) {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			jobs, err := (&Job{}).JobList()
+			if err != nil {
+				continue
+			}
+			for _, job := range jobs {
+				if err := job.checkMisfire(time.Now()); err != nil {
+					fmt.Println("任务", job.Name, " 检查错过执行出错 : ", err)
+				}
+			}
+		}
+	})
+}
+
+// 检查任务从最后一次调度到现在是否有错过的执行
+func (j *Job) checkMisfire(now time.Time) error {
+	if j.Paused {
+		return nil
+	}
+
+	schedule, err := common.ParseCron(j.CronExpr, j.Timezone)
+	if err != nil {
+		return err
+	}
+
+	last, exist, err := common.LastScheduleTime(j.Name)
+	if err != nil {
+		return err
+	}
+	// 还没有调度记录 从现在开始计算
+	if !exist {
+		return common.SaveLastScheduleTime(j.Name, now.UnixNano()/1000000)
+	}
+
+	// 超过宽限时间还没有worker调度的计划时间 就是错过的执行
+	deadline := now.Add(-common.MISFIRE_GRACE * time.Second)
+	var missed []time.Time
+	for t := schedule.Next(time.Unix(0, last*int64(time.Millisecond))); !t.IsZero() && !t.After(deadline); t = schedule.Next(t) {
+		missed = append(missed, t)
+		if len(missed) >= common.MISFIRE_MAX_SCAN {
+			break
+		}
+	}
+	if len(missed) == 0 {
+		return nil
+	}
+
+	// 根据策略决定补执行哪几次 补执行最近的几次
+	var run []time.Time
+	switch j.MisfirePolicy {
+	case common.MISFIRE_RUN_ONCE:
+		run = missed[len(missed)-1:]
+	case common.MISFIRE_RUN_ALL:
+		limit := j.MisfireLimit
+		if limit <= 0 {
+			limit = common.MISFIRE_LIMIT
+		}
+		run = missed
+		if int64(len(run)) > limit {
+			run = missed[int64(len(missed))-limit:]
+		}
+	}
+
+	// 需要补执行时 等有可用的worker再处理
+	if len(run) > 0 && !workerAvailable(j.Selector) {
+		return nil
+	}
+
+	for _, t := range run {
+		trigger := &common.JobTrigger{
+			Name: j.Name,
+			Type: common.JOB_TRIGGER_MISFIRE,
+			Time: t.UnixNano() / 1000000,
+		}
+		if err := j.fire(trigger); err != nil {
+			return err
+		}
+	}
+
+	// 没有补执行的记录为错过  日志存储没有初始化时不记录
+	if common.Sink != nil {
+		for _, t := range missed[:len(missed)-len(run)] {
+			planTime := t.UnixNano() / 1000000
+			common.Sink.Append(&common.JobLog{
+				JobName:      j.Name,
+				Command:      j.Command,
+				Error:        "没有worker在计划时间调度该任务",
+				PlanTime:     planTime,
+				ScheduleTime: now.UnixNano() / 1000000,
+				StartTime:    now.UnixNano() / 1000000,
+				EndTime:      now.UnixNano() / 1000000,
+				Reason:       common.JOB_REASON_MISSED,
+				Trigger:      common.JOB_TRIGGER_CRON,
+				ExitCode:     -1,
+			})
+		}
+	}
+
+	if skipped := len(missed) - len(run); skipped > 0 {
+		common.SendAlert(common.NewJobAlert(j.Name, j.Labels, j.Alert, common.ALERT_TYPE_MISSED,
+			fmt.Sprintf("任务错过了%d次执行 最后一次计划时间 %s", skipped, missed[skipped-1].Format(common.TIME_FORMAT))))
+	}
+
+	return common.SaveLastScheduleTime(j.Name, missed[len(missed)-1].UnixNano()/1000000)
+}
+
+// 是否有标签匹配的worker在线
+func workerAvailable(selector map[string]string) bool {
+	workers, err := WorkerList()
+	if err != nil {
+		return false
+	}
+	for _, worker := range workers {
+		if worker.Match(selector) {
+			return true
+		}
+	}
+	return false
+}
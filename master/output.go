@@ -0,0 +1,64 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"scheduler/common"
+)
+
+// 实时读取任务的输出  先返回etcd中最近一次发布的输出 然后持续返回新的输出 直到ctx被取消
+// send返回错误时停止读取
+func WatchJobOutput(ctx context.Context, name string, send func(*common.JobOutput, []*common.OutputLine) error) error {
+	prefix := common.JOB_OUTPUT_DIR + name + "/"
+
+	getResp, err := common.ETCD.KV.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+
+	// 每次执行已经发送到的行号
+	sent := make(map[string]int64)
+	handle := func(kv *mvccpb.KeyValue) error {
+		output := &common.JobOutput{}
+		if err := json.Unmarshal(kv.Value, output); err != nil {
+			return nil
+		}
+		key := string(kv.Key)
+		lines := output.After(sent[key])
+		sent[key] = output.Seq
+		if len(lines) == 0 && !output.Done {
+			return nil
+		}
+		return send(output, lines)
+	}
+
+	for _, kv := range getResp.Kvs {
+		if err := handle(kv); err != nil {
+			return err
+		}
+	}
+
+	watcher := clientv3.NewWatcher(common.ETCD.Client)
+	defer watcher.Close()
+
+	watchChan := watcher.Watch(ctx, prefix,
+		clientv3.WithPrefix(), clientv3.WithRev(getResp.Header.Revision+1))
+	for watchResp := range watchChan {
+		if err := watchResp.Err(); err != nil {
+			return err
+		}
+		for _, event := range watchResp.Events {
+			switch event.Type {
+			case mvccpb.PUT:
+				if err := handle(event.Kv); err != nil {
+					return err
+				}
+			case mvccpb.DELETE:
+				delete(sent, string(event.Kv.Key))
+			}
+		}
+	}
+	return ctx.Err()
+}
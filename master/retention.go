@@ -0,0 +1,156 @@
+package master
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"scheduler/common"
+	"time"
+)
+
+// 初始化日志清理  只有leader按保留策略清理过期的日志
+func InitRetention() {
+	if common.Retention == nil || common.Sink == nil {
+		return
+	}
+
+	common.RunAsLeader(func(ctx context.Context) {
+		ticker := time.NewTicker(common.Retention.Every())
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := compactLogs(common.Sink.Store, time.Now()); err != nil {
+				fmt.Println("清理过期日志出错 : ", err)
+			}
+		}
+	})
+}
+
+// 按每个任务的保留策略清理日志
+func compactLogs(store common.LogStore, now time.Time) error {
+	policies := make(map[string]*common.RetentionPolicy)
+	jobs, err := (&Job{}).JobList()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		policies[job.Name] = job.Retention
+	}
+
+	// 已经删除的任务也有日志 使用全局策略
+	names, err := store.JobNames()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		deadline, err := expiredBefore(store, name, common.Retention.Policy(policies[name]), now)
+		if err != nil {
+			return err
+		}
+		if deadline == 0 {
+			continue
+		}
+
+		// 归档成功后才删除
+		if common.Retention.ArchiveDir != "" {
+			if err := archiveLogs(store, name, deadline); err != nil {
+				return err
+			}
+		}
+		if _, err := store.DeleteBefore(name, deadline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 返回任务日志的过期时间 开始时间早于它的日志需要清理  不需要清理时返回0
+func expiredBefore(store common.LogStore, name string, policy common.RetentionPolicy, now time.Time) (int64, error) {
+	var deadline int64
+
+	if policy.Days > 0 {
+		deadline = now.Add(-time.Duration(policy.Days)*24*time.Hour).UnixNano() / 1000000
+	}
+
+	// 第MaxRuns新的日志之前的日志都需要清理
+	if policy.MaxRuns > 0 {
+		page, err := store.Query(&common.Log{JobName: name, Limit: policy.MaxRuns})
+		if err != nil {
+			return 0, err
+		}
+		if page.NextCursor != "" {
+			if last := page.Logs[len(page.Logs)-1]; last.StartTime > deadline {
+				deadline = last.StartTime
+			}
+		}
+	}
+	return deadline, nil
+}
+
+// 把过期的日志分批写成gzip压缩的jsonl文件  archive_dir/任务名/时间-批次.jsonl.gz
+func archiveLogs(store common.LogStore, name string, deadline int64) error {
+	dir := filepath.Join(common.Retention.ArchiveDir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	query := &common.Log{JobName: name, StartTo: deadline, Limit: common.RETENTION_BATCH}
+	prefix := time.Now().Format("20060102150405")
+	for batch := 1; ; batch++ {
+		page, err := store.Query(query)
+		if err != nil {
+			return err
+		}
+		if len(page.Logs) == 0 {
+			return nil
+		}
+
+		path := filepath.Join(dir, fmt.Sprintf("%s-%04d.jsonl.gz", prefix, batch))
+		if err := writeArchive(path, page.Logs); err != nil {
+			return err
+		}
+
+		if page.NextCursor == "" {
+			return nil
+		}
+		query.Cursor = page.NextCursor
+	}
+}
+
+func writeArchive(path string, logs []*common.JobLog) (err error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	// 写入失败时删除不完整的文件
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(path)
+		}
+	}()
+
+	writer := gzip.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, log := range logs {
+		if err = encoder.Encode(log); err != nil {
+			return err
+		}
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	return file.Close()
+}
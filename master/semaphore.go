@@ -0,0 +1,131 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/coreos/etcd/clientv3"
+	"scheduler/common"
+	"strings"
+)
+
+// 信号量的状态  持有名额和等待名额的任务实例
+type SemaphoreStatus struct {
+	*common.Semaphore
+	Holders []*common.SemaphoreHolder `json:"holders"`
+	Waiters []*common.SemaphoreHolder `json:"waiters"`
+}
+
+// 保存信号量  返回修改前的定义
+// 减小容量不影响已经持有名额的任务 之后的任务按新的容量获取
+func SaveSemaphore(sem *common.Semaphore) (*common.Semaphore, error) {
+	old := &common.Semaphore{}
+
+	var errs common.ValidationErrors
+	if sem.Name == "" {
+		errs.Add("name", "信号量名不能为空")
+	} else if strings.Contains(sem.Name, "/") {
+		errs.Add("name", "信号量名不能包含'/'")
+	}
+	if sem.Capacity <= 0 {
+		errs.Add("capacity", "容量必须大于0")
+	}
+	if err := errs.Err(); err != nil {
+		return old, err
+	}
+
+	value, err := json.Marshal(sem)
+	if err != nil {
+		return old, err
+	}
+
+	putResp, err := common.ETCD.KV.Put(context.TODO(), common.SEMAPHORE_SAVE_DIR+sem.Name, string(value), clientv3.WithPrevKV())
+	if err != nil {
+		return old, err
+	}
+
+	if putResp.PrevKv != nil {
+		json.Unmarshal(putResp.PrevKv.Value, old)
+	}
+	return old, nil
+}
+
+// 删除信号量  需要该信号量的任务之后会执行失败
+func DeleteSemaphore(name string) (*common.Semaphore, error) {
+	old := &common.Semaphore{}
+	delResp, err := common.ETCD.KV.Delete(context.TODO(), common.SEMAPHORE_SAVE_DIR+name, clientv3.WithPrevKV())
+	if err != nil {
+		return old, err
+	}
+
+	if len(delResp.PrevKvs) > 0 {
+		json.Unmarshal(delResp.PrevKvs[0].Value, old)
+	}
+	return old, nil
+}
+
+// 返回所有信号量的状态
+func SemaphoreList() ([]*SemaphoreStatus, error) {
+	list := make([]*SemaphoreStatus, 0)
+
+	getResp, err := common.ETCD.KV.Get(context.TODO(), common.SEMAPHORE_SAVE_DIR, clientv3.WithPrefix())
+	if err != nil {
+		return list, err
+	}
+
+	status := make(map[string]*SemaphoreStatus)
+	for _, kv := range getResp.Kvs {
+		sem := &common.Semaphore{}
+		if err := json.Unmarshal(kv.Value, sem); err != nil {
+			continue
+		}
+		s := &SemaphoreStatus{
+			Semaphore: sem,
+			Holders:   make([]*common.SemaphoreHolder, 0),
+			Waiters:   make([]*common.SemaphoreHolder, 0),
+		}
+		status[sem.Name] = s
+		list = append(list, s)
+	}
+
+	// 名额和等待者的key都以信号量名开头
+	holders, err := semaphoreHolders(common.SEMAPHORE_SLOT_DIR)
+	if err != nil {
+		return list, err
+	}
+	for name, hs := range holders {
+		if s, exist := status[name]; exist {
+			s.Holders = hs
+		}
+	}
+
+	waiters, err := semaphoreHolders(common.SEMAPHORE_WAIT_DIR)
+	if err != nil {
+		return list, err
+	}
+	for name, ws := range waiters {
+		if s, exist := status[name]; exist {
+			s.Waiters = ws
+		}
+	}
+	return list, nil
+}
+
+// 读取目录下的任务实例 按信号量名分组  等待者按登记的先后排序
+func semaphoreHolders(dir string) (map[string][]*common.SemaphoreHolder, error) {
+	getResp, err := common.ETCD.KV.Get(context.TODO(), dir, clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByCreateRevision, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+
+	holders := make(map[string][]*common.SemaphoreHolder)
+	for _, kv := range getResp.Kvs {
+		holder := &common.SemaphoreHolder{}
+		if err := json.Unmarshal(kv.Value, holder); err != nil {
+			continue
+		}
+		name := strings.SplitN(common.ExtractName(string(kv.Key), dir), "/", 2)[0]
+		holders[name] = append(holders[name], holder)
+	}
+	return holders, nil
+}
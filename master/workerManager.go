@@ -2,24 +2,30 @@ package master
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/coreos/etcd/clientv3"
 	"scheduler/common"
 )
 
 // 返回注册到etcd的所有worker
-func WorkerList() (*[]string, error) {
-	var rs []string
+func WorkerList() ([]*common.WorkerInfo, error) {
+	var rs []*common.WorkerInfo
 
 	getResp, err := common.ETCD.KV.Get(context.TODO(), common.JOB_WORKER_DIR, clientv3.WithPrefix())
 	if err != nil {
-		return &rs, err
+		return rs, err
 	}
 
 	if len(getResp.Kvs) > 0 {
 		for _, v := range getResp.Kvs {
-			rs = append(rs, common.ExtractName(string(v.Key), common.JOB_WORKER_DIR))
+			// 旧版本的worker只注册了ip
+			worker := &common.WorkerInfo{}
+			if err := json.Unmarshal(v.Value, worker); err != nil || worker.IP == "" {
+				worker = &common.WorkerInfo{IP: common.ExtractName(string(v.Key), common.JOB_WORKER_DIR)}
+			}
+			rs = append(rs, worker)
 		}
 	}
 
-	return &rs, nil
+	return rs, nil
 }
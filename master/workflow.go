@@ -0,0 +1,553 @@
+package master
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/coreos/etcd/clientv3"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"scheduler/common"
+	"strings"
+	"time"
+)
+
+// 工作流 由多个任务和任务之间的依赖组成
+type Workflow struct {
+	Name        string          `json:"name" bson:"name"`                 // 工作流名
+	CronExpr    string          `json:"cron_expr" bson:"cron_expr"`       // cron表达式 为空表示只能手动触发
+	Timezone    string          `json:"timezone" bson:"timezone"`         // cron表达式使用的时区 为空表示本地时区
+	Jobs        []string        `json:"jobs" bson:"jobs"`                 // 工作流包含的任务 依赖关系中出现的任务会自动加入
+	Edges       []*WorkflowEdge `json:"edges" bson:"edges"`               // 任务之间的依赖
+	NodeTimeout int64           `json:"node_timeout" bson:"node_timeout"` // 任务从触发到上报结束的最长时间 秒 为0使用默认值 超时的任务视为执行超时
+}
+
+// 任务依赖 上游任务结束后满足条件才触发下游任务
+type WorkflowEdge struct {
+	From      string `json:"from" bson:"from"`           // 上游任务
+	To        string `json:"to" bson:"to"`               // 下游任务
+	Condition string `json:"condition" bson:"condition"` // 触发条件 success(默认) / failure / always
+}
+
+// 工作流的一次运行
+type WorkflowRun struct {
+	RunID      string            `json:"runId" bson:"runId"`           // 运行id
+	Workflow   string            `json:"workflow" bson:"workflow"`     // 工作流名
+	Status     string            `json:"status" bson:"status"`         // running / success / failed
+	Jobs       map[string]string `json:"jobs" bson:"jobs"`             // 每个任务的状态 pending / running / 任务的结束原因
+	Started    map[string]int64  `json:"started" bson:"started"`       // 每个任务的触发时间 用于判断任务超时
+	User       string            `json:"user" bson:"user"`             // 触发的用户 定时触发时为空
+	StartTime  int64             `json:"startTime" bson:"startTime"`   // 开始时间
+	EndTime    int64             `json:"endTime" bson:"endTime"`       // 结束时间
+	Definition *Workflow         `json:"definition" bson:"definition"` // 运行时的工作流定义 运行过程中修改工作流不影响本次运行
+}
+
+// 工作流中所有的任务
+func (w *Workflow) nodes() []string {
+	var nodes []string
+	exist := make(map[string]bool)
+	add := func(name string) {
+		if !exist[name] {
+			exist[name] = true
+			nodes = append(nodes, name)
+		}
+	}
+
+	for _, name := range w.Jobs {
+		add(name)
+	}
+	for _, edge := range w.Edges {
+		add(edge.From)
+		add(edge.To)
+	}
+	return nodes
+}
+
+// 检查工作流定义 任务必须存在并且不能有循环依赖
+func (w *Workflow) validate() error {
+	if w.Name == "" || strings.Contains(w.Name, "/") {
+		return fmt.Errorf("工作流名不能为空 也不能包含'/' : %s", w.Name)
+	}
+	if w.CronExpr != "" {
+		if _, err := common.ParseCron(w.CronExpr, w.Timezone); err != nil {
+			return fmt.Errorf("cron表达式错误 : %s", err)
+		}
+	}
+
+	if w.NodeTimeout < 0 {
+		return fmt.Errorf("任务超时时间不能小于0 : %d", w.NodeTimeout)
+	}
+
+	nodes := w.nodes()
+	if len(nodes) == 0 {
+		return fmt.Errorf("工作流至少需要包含一个任务")
+	}
+	if err := w.checkDependencies(); err != nil {
+		return err
+	}
+	for _, name := range nodes {
+		if _, _, err := getJob(name); err != nil {
+			return fmt.Errorf("任务 %s : %s", name, err)
+		}
+	}
+	return nil
+}
+
+// 检查依赖条件 并用拓扑排序检查循环依赖  还有入度不为0的任务说明存在循环依赖
+func (w *Workflow) checkDependencies() error {
+	inDegree := make(map[string]int)
+	for _, edge := range w.Edges {
+		switch edge.Condition {
+		case "":
+			edge.Condition = common.WORKFLOW_ON_SUCCESS
+		case common.WORKFLOW_ON_SUCCESS, common.WORKFLOW_ON_FAILURE, common.WORKFLOW_ON_ALWAYS:
+		default:
+			return fmt.Errorf("不支持的依赖条件 : %s", edge.Condition)
+		}
+		inDegree[edge.To]++
+	}
+
+	var queue []string
+	for _, name := range w.nodes() {
+		if inDegree[name] == 0 {
+			queue = append(queue, name)
+		}
+	}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, edge := range w.Edges {
+			if edge.From != name {
+				continue
+			}
+			if inDegree[edge.To]--; inDegree[edge.To] == 0 {
+				queue = append(queue, edge.To)
+			}
+		}
+	}
+	for _, degree := range inDegree {
+		if degree > 0 {
+			return common.ERR_WORKFLOW_CYCLE
+		}
+	}
+	return nil
+}
+
+// 任务从触发到上报结束的最长时间 秒
+func (w *Workflow) nodeTimeout() int64 {
+	if w.NodeTimeout > 0 {
+		return w.NodeTimeout
+	}
+	return common.WORKFLOW_NODE_TIMEOUT
+}
+
+// 保存工作流到etcd
+func (w *Workflow) SaveWorkflow() (*Workflow, error) {
+	old := &Workflow{}
+	if err := w.validate(); err != nil {
+		return old, err
+	}
+
+	value, err := json.Marshal(w)
+	if err != nil {
+		return old, err
+	}
+
+	putResp, err := common.ETCD.KV.Put(context.TODO(), common.WORKFLOW_SAVE_DIR+w.Name, string(value), clientv3.WithPrevKV())
+	if err != nil {
+		return old, err
+	}
+
+	// 如果是更新操作则返回原来的工作流
+	if putResp.PrevKv != nil {
+		json.Unmarshal(putResp.PrevKv.Value, old)
+	}
+	return old, nil
+}
+
+// 删除工作流  正在运行的实例会继续运行完
+func (w *Workflow) DeleteWorkflow() (*Workflow, error) {
+	old := &Workflow{}
+	delResp, err := common.ETCD.KV.Delete(context.TODO(), common.WORKFLOW_SAVE_DIR+w.Name, clientv3.WithPrevKV())
+	if err != nil {
+		return old, err
+	}
+
+	if len(delResp.PrevKvs) > 0 {
+		json.Unmarshal(delResp.PrevKvs[0].Value, old)
+	}
+	return old, nil
+}
+
+// 返回所有的工作流
+func WorkflowList() ([]*Workflow, error) {
+	var workflows []*Workflow
+
+	getResp, err := common.ETCD.KV.Get(context.TODO(), common.WORKFLOW_SAVE_DIR, clientv3.WithPrefix())
+	if err != nil {
+		return workflows, err
+	}
+
+	for _, v := range getResp.Kvs {
+		workflow := &Workflow{}
+		if err := json.Unmarshal(v.Value, workflow); err != nil {
+			continue
+		}
+		workflows = append(workflows, workflow)
+	}
+	return workflows, nil
+}
+
+// 手动触发一次工作流
+func (w *Workflow) RunWorkflow(user string) (*WorkflowRun, error) {
+	getResp, err := common.ETCD.KV.Get(context.TODO(), common.WORKFLOW_SAVE_DIR+w.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(getResp.Kvs) == 0 {
+		return nil, common.ERR_WORKFLOW_NOT_FOUND
+	}
+
+	workflow := &Workflow{}
+	if err := json.Unmarshal(getResp.Kvs[0].Value, workflow); err != nil {
+		return nil, err
+	}
+	return startWorkflowRun(workflow, user)
+}
+
+// 查询工作流的运行状态  运行中的从etcd读取 已结束的从MongoDB读取
+func WorkflowRunStatus(runID string) (*WorkflowRun, error) {
+	run := &WorkflowRun{}
+	getResp, err := common.ETCD.KV.Get(context.TODO(), common.WORKFLOW_RUN_DIR+runID)
+	if err != nil {
+		return run, err
+	}
+	if len(getResp.Kvs) > 0 {
+		err := json.Unmarshal(getResp.Kvs[0].Value, run)
+		return run, err
+	}
+
+	if common.MongoDB == nil {
+		return run, common.ERR_RUN_STORE_UNAVAILABLE
+	}
+	err = common.MongoDB.WorkflowRuns.FindOne(context.TODO(), common.WorkflowRunFilter{RunID: runID}).Decode(run)
+	return run, err
+}
+
+// 创建一次工作流运行  由leader的工作流引擎触发其中的任务
+func startWorkflowRun(workflow *Workflow, user string) (*WorkflowRun, error) {
+	now := time.Now()
+	run := &WorkflowRun{
+		RunID:      fmt.Sprintf("%s-%d", workflow.Name, now.UnixNano()),
+		Workflow:   workflow.Name,
+		Status:     common.WORKFLOW_STATUS_RUNNING,
+		Jobs:       make(map[string]string),
+		Started:    make(map[string]int64),
+		User:       user,
+		StartTime:  now.UnixNano() / 1000000,
+		Definition: workflow,
+	}
+	for _, name := range workflow.nodes() {
+		run.Jobs[name] = common.WORKFLOW_JOB_PENDING
+	}
+
+	if err := run.save(); err != nil {
+		return run, err
+	}
+	return run, nil
+}
+
+// 判断上游任务的结束状态是否满足依赖条件
+func (e *WorkflowEdge) satisfied(status string) bool {
+	switch e.Condition {
+	case common.WORKFLOW_ON_ALWAYS:
+		return true
+	case common.WORKFLOW_ON_FAILURE:
+		return status == common.JOB_REASON_FAILED || status == common.JOB_REASON_TIMEOUT || status == common.JOB_REASON_KILLED
+	default:
+		return status == common.JOB_REASON_SUCCESS
+	}
+}
+
+// 任务是否已经结束
+func workflowJobDone(status string) bool {
+	return status != common.WORKFLOW_JOB_PENDING && status != common.WORKFLOW_JOB_RUNNING
+}
+
+// 推进工作流的运行  触发上游都已结束的任务 有变化时保存运行状态
+func (r *WorkflowRun) advance(changed bool) error {
+	if r.Started == nil {
+		r.Started = make(map[string]int64)
+	}
+
+	// 任务被暂停 没有worker执行或者worker挂掉时不会上报结束  超时后视为执行超时
+	now := time.Now().UnixNano() / 1000000
+	timeout := r.Definition.nodeTimeout() * 1000
+	for name, status := range r.Jobs {
+		if status != common.WORKFLOW_JOB_RUNNING {
+			continue
+		}
+		if started, exist := r.Started[name]; !exist {
+			r.Started[name], changed = now, true
+		} else if now-started > timeout {
+			fmt.Println("工作流", r.RunID, " 任务", name, "超时没有上报结束")
+			r.Jobs[name], changed = common.JOB_REASON_TIMEOUT, true
+		}
+	}
+
+	for progress := true; progress; {
+		progress = false
+		for _, name := range r.Definition.nodes() {
+			if r.Jobs[name] != common.WORKFLOW_JOB_PENDING {
+				continue
+			}
+
+			// 上游任务都结束后 所有依赖条件都满足才执行 否则跳过该任务
+			ready, satisfied := true, true
+			for _, edge := range r.Definition.Edges {
+				if edge.To != name {
+					continue
+				}
+				if !workflowJobDone(r.Jobs[edge.From]) {
+					ready = false
+					break
+				}
+				satisfied = satisfied && edge.satisfied(r.Jobs[edge.From])
+			}
+			if !ready {
+				continue
+			}
+
+			progress, changed = true, true
+			if !satisfied {
+				r.Jobs[name] = common.JOB_REASON_SKIPPED
+				continue
+			}
+			status, err := r.fireJob(name)
+			if err != nil {
+				fmt.Println("工作流", r.RunID, " 触发任务", name, "出错 : ", err)
+			}
+			r.Jobs[name] = status
+			if status == common.WORKFLOW_JOB_RUNNING {
+				r.Started[name] = now
+			}
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	// 所有任务都结束后 工作流运行结束
+	finished := true
+	r.Status = common.WORKFLOW_STATUS_SUCCESS
+	for _, status := range r.Jobs {
+		if !workflowJobDone(status) {
+			finished = false
+		} else if status != common.JOB_REASON_SUCCESS {
+			r.Status = common.WORKFLOW_STATUS_FAILED
+		}
+	}
+	if !finished {
+		r.Status = common.WORKFLOW_STATUS_RUNNING
+	} else {
+		r.EndTime = time.Now().UnixNano() / 1000000
+	}
+
+	return r.save()
+}
+
+// 触发工作流中的一个任务  返回任务的状态
+// 暂停的任务直接跳过  任务不存在或者没有可以执行的worker时视为失败
+func (r *WorkflowRun) fireJob(name string) (string, error) {
+	job, _, err := getJob(name)
+	if err != nil {
+		return common.JOB_REASON_FAILED, err
+	}
+	if job.Paused {
+		return common.JOB_REASON_SKIPPED, common.ERR_JOB_PAUSED
+	}
+
+	workers, err := WorkerList()
+	if err != nil {
+		return common.JOB_REASON_FAILED, err
+	}
+	matched := false
+	for _, worker := range workers {
+		matched = matched || worker.Match(job.Selector)
+	}
+	if !matched {
+		return common.JOB_REASON_FAILED, common.ERR_NO_WORKER_AVAILABLE
+	}
+
+	err = job.fire(&common.JobTrigger{
+		Name:          name,
+		Type:          common.JOB_TRIGGER_WORKFLOW,
+		User:          r.User,
+		Time:          time.Now().UnixNano() / 1000000,
+		WorkflowRunID: r.RunID,
+	})
+	if err != nil {
+		return common.JOB_REASON_FAILED, err
+	}
+	return common.WORKFLOW_JOB_RUNNING, nil
+}
+
+// 保存运行状态  运行中的状态保存在etcd 同时记录到MongoDB
+// 结束的运行先写入MongoDB再从etcd删除  写入失败时下次重新处理  没有连接MongoDB时不保存历史
+func (r *WorkflowRun) save() error {
+	runKey := common.WORKFLOW_RUN_DIR + r.RunID
+	if r.Status == common.WORKFLOW_STATUS_RUNNING {
+		value, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if _, err := common.ETCD.KV.Put(context.TODO(), runKey, string(value)); err != nil {
+			return err
+		}
+	}
+
+	if common.MongoDB != nil {
+		_, err := common.MongoDB.WorkflowRuns.ReplaceOne(context.TODO(), common.WorkflowRunFilter{RunID: r.RunID}, r,
+			options.Replace().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.Status != common.WORKFLOW_STATUS_RUNNING {
+		_, err := common.ETCD.KV.Delete(context.TODO(), runKey)
+		return err
+	}
+	return nil
+}
+
+// 工作流的定时调度计划
+type workflowPlan struct {
+	cronExpr string
+	timezone string
+	expr     *common.CronSchedule
+	nextTime time.Time
+}
+
+// 初始化工作流引擎  只有leader会推进工作流的运行
+func InitWorkflowEngine() {
+	common.RunAsLeader(workflowLoop)
+}
+
+// 每次成为leader后重新计算调度计划
+func workflowLoop(ctx context.Context) {
+	plans := make(map[string]*workflowPlan)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		processWorkflowRuns()
+		scheduleWorkflows(plans)
+	}
+}
+
+// 推进所有运行中的工作流
+// 先处理worker上报的任务结束记录 /cron/workflow/done/runId/jobName  再触发可以执行的任务
+func processWorkflowRuns() {
+	runResp, err := common.ETCD.KV.Get(context.TODO(), common.WORKFLOW_RUN_DIR, clientv3.WithPrefix())
+	if err != nil {
+		return
+	}
+	doneResp, err := common.ETCD.KV.Get(context.TODO(), common.WORKFLOW_DONE_DIR, clientv3.WithPrefix())
+	if err != nil {
+		return
+	}
+
+	runs := make(map[string]*WorkflowRun)
+	for _, kv := range runResp.Kvs {
+		run := &WorkflowRun{}
+		if err := json.Unmarshal(kv.Value, run); err != nil {
+			continue
+		}
+		runs[run.RunID] = run
+	}
+
+	// 记录任务的结束状态  已经超时的任务不再接收结束记录
+	changed := make(map[string]bool)
+	for _, kv := range doneResp.Kvs {
+		names := strings.SplitN(common.ExtractName(string(kv.Key), common.WORKFLOW_DONE_DIR), "/", 2)
+		if len(names) != 2 {
+			continue
+		}
+		if run, exist := runs[names[0]]; exist {
+			if run.Jobs[names[1]] == common.WORKFLOW_JOB_RUNNING {
+				run.Jobs[names[1]] = string(kv.Value)
+				changed[run.RunID] = true
+			}
+		}
+	}
+
+	failed := make(map[string]bool)
+	for _, run := range runs {
+		if err := run.advance(changed[run.RunID]); err != nil {
+			fmt.Println("推进工作流", run.RunID, "出错 : ", err)
+			failed[run.RunID] = true
+		}
+	}
+
+	// 保存失败的工作流下次重新处理结束记录
+	for _, kv := range doneResp.Kvs {
+		runID := strings.SplitN(common.ExtractName(string(kv.Key), common.WORKFLOW_DONE_DIR), "/", 2)[0]
+		if !failed[runID] {
+			common.ETCD.KV.Delete(context.TODO(), string(kv.Key))
+		}
+	}
+}
+
+// 按cron表达式定时触发工作流
+func scheduleWorkflows(plans map[string]*workflowPlan) {
+	workflows, err := WorkflowList()
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	exist := make(map[string]bool)
+	for _, workflow := range workflows {
+		if workflow.CronExpr == "" {
+			continue
+		}
+		exist[workflow.Name] = true
+
+		// 新增的工作流 或者修改了cron表达式和时区
+		plan, ok := plans[workflow.Name]
+		if !ok || plan.cronExpr != workflow.CronExpr || plan.timezone != workflow.Timezone {
+			expr, err := common.ParseCron(workflow.CronExpr, workflow.Timezone)
+			if err != nil {
+				continue
+			}
+			plan = &workflowPlan{
+				cronExpr: workflow.CronExpr,
+				timezone: workflow.Timezone,
+				expr:     expr,
+				nextTime: expr.Next(now),
+			}
+			plans[workflow.Name] = plan
+		}
+
+		if !plan.nextTime.After(now) {
+			if _, err := startWorkflowRun(workflow, ""); err != nil {
+				fmt.Println("工作流", workflow.Name, " 定时触发出错 : ", err)
+			}
+			plan.nextTime = plan.expr.Next(now)
+		}
+	}
+
+	// 删除已经不存在的工作流
+	for name := range plans {
+		if !exist[name] {
+			delete(plans, name)
+		}
+	}
+}
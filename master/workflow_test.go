@@ -0,0 +1,62 @@
+package master
+
+import (
+	"scheduler/common"
+	"testing"
+)
+
+func TestWorkflowCheckDependencies(t *testing.T) {
+	cases := []struct {
+		name  string
+		edges []*WorkflowEdge
+		cycle bool
+	}{
+		{"没有依赖", nil, false},
+		{"有向无环图", []*WorkflowEdge{
+			{From: "a", To: "b"},
+			{From: "a", To: "c", Condition: common.WORKFLOW_ON_FAILURE},
+			{From: "b", To: "d"},
+			{From: "c", To: "d", Condition: common.WORKFLOW_ON_ALWAYS},
+		}, false},
+		{"循环依赖", []*WorkflowEdge{
+			{From: "a", To: "b"},
+			{From: "b", To: "c"},
+			{From: "c", To: "a"},
+		}, true},
+		{"下游存在循环依赖", []*WorkflowEdge{
+			{From: "a", To: "b"},
+			{From: "b", To: "c"},
+			{From: "c", To: "b"},
+		}, true},
+		{"依赖自己", []*WorkflowEdge{{From: "a", To: "a"}}, true},
+	}
+
+	for _, c := range cases {
+		w := &Workflow{Name: "flow", Jobs: []string{"a"}, Edges: c.edges}
+		err := w.checkDependencies()
+		if c.cycle && err != common.ERR_WORKFLOW_CYCLE {
+			t.Errorf("%s : 错误 %v 期望 %v", c.name, err, common.ERR_WORKFLOW_CYCLE)
+		}
+		if !c.cycle && err != nil {
+			t.Errorf("%s : %s", c.name, err)
+		}
+	}
+}
+
+// 没有指定条件时默认上游成功后触发
+func TestWorkflowDefaultCondition(t *testing.T) {
+	w := &Workflow{Edges: []*WorkflowEdge{{From: "a", To: "b"}}}
+	if err := w.checkDependencies(); err != nil {
+		t.Fatal(err)
+	}
+	if w.Edges[0].Condition != common.WORKFLOW_ON_SUCCESS {
+		t.Fatalf("默认条件 %q 期望 %q", w.Edges[0].Condition, common.WORKFLOW_ON_SUCCESS)
+	}
+}
+
+func TestWorkflowUnsupportedCondition(t *testing.T) {
+	w := &Workflow{Edges: []*WorkflowEdge{{From: "a", To: "b", Condition: "sometimes"}}}
+	if err := w.checkDependencies(); err == nil || err == common.ERR_WORKFLOW_CYCLE {
+		t.Fatalf("不支持的依赖条件应该返回错误 : %v", err)
+	}
+}
@@ -11,9 +11,29 @@ func init() {
 	beego.Router("/*", &controller.MainController{})
 
 	beego.Router("/job/save", &controller.ApiController{}, "post:Save")
+	beego.Router("/job/preview", &controller.ApiController{}, "post:PreviewJob")
 	beego.Router("/job/delete", &controller.ApiController{}, "post:Delete")
 	beego.Router("/job/jobList", &controller.ApiController{}, "get:JobList")
 	beego.Router("/job/killJob", &controller.ApiController{}, "post:KillJob")
+	beego.Router("/job/run", &controller.ApiController{}, "post:RunJob")
+	beego.Router("/job/pause", &controller.ApiController{}, "post:PauseJob")
+	beego.Router("/job/resume", &controller.ApiController{}, "post:ResumeJob")
 	beego.Router("/job/log", &controller.ApiController{}, "post:JobLog")
-	beego.Router("/worker1/list", &controller.ApiController{}, "get:WorkList")
+	beego.Router("/job/log/stream", &controller.ApiController{}, "get:StreamJobLog")
+	beego.Router("/log/stats", &controller.ApiController{}, "get:LogStats")
+	beego.Router("/alert/test", &controller.ApiController{}, "post:TestAlert")
+	beego.Router("/alert/list", &controller.ApiController{}, "get:AlertList")
+	beego.Router("/alert/ack", &controller.ApiController{}, "post:AckAlert")
+	beego.Router("/worker/list", &controller.ApiController{}, "get:WorkList")
+	beego.Router("/cluster/leader", &controller.ApiController{}, "get:ClusterLeader")
+
+	beego.Router("/workflow/save", &controller.ApiController{}, "post:SaveWorkflow")
+	beego.Router("/workflow/delete", &controller.ApiController{}, "post:DeleteWorkflow")
+	beego.Router("/workflow/list", &controller.ApiController{}, "get:WorkflowList")
+	beego.Router("/workflow/run", &controller.ApiController{}, "post:RunWorkflow")
+	beego.Router("/workflow/status", &controller.ApiController{}, "get:WorkflowStatus")
+
+	beego.Router("/semaphore/save", &controller.ApiController{}, "post:SaveSemaphore")
+	beego.Router("/semaphore/delete", &controller.ApiController{}, "post:DeleteSemaphore")
+	beego.Router("/semaphore/list", &controller.ApiController{}, "get:SemaphoreList")
 }
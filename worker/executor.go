@@ -1,11 +1,13 @@
 package worker
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"math/rand"
+	"os"
 	"os/exec"
 	"scheduler/common"
+	"sync"
 	"time"
 )
 
@@ -19,6 +21,17 @@ type JobExeResult struct {
 	endTime   time.Time
 	outPut    []byte
 	err       error
+	attempt   int64 // 第几次执行 从1开始
+	timeout   bool  // 是否因为执行超时被取消
+	final     bool  // 是否为最后一次执行  成功或者不再重试
+
+	lockFailed bool          // 是否因为获取锁出错没有执行
+	lockLost   bool          // 执行期间任务锁的租约是否丢失
+	exitCode   int           // 进程的退出码 没有执行或者被信号终止时为-1
+	signal     string        // 终止进程的信号
+	userTime   time.Duration // 用户态CPU时间
+	sysTime    time.Duration // 内核态CPU时间
+	maxRSS     int64         // 最大常驻内存 KB
 }
 
 var Exe *Executor
@@ -30,53 +43,230 @@ func InitExecutor() {
 
 func (e *Executor) ExecuteJob(info *JobExecuteInfo) {
 	go func() {
-		exeRes := &JobExeResult{exeInfo: info, outPut: make([]byte, 0)}
+		// 任务执行结束并释放锁后通知等待的实例
+		defer close(info.Done)
+
+		// Replace策略下 等待被取消的旧实例释放锁后再开始
+		for _, old := range info.waitFor {
+			<-old.Done
+		}
+
 		// 为了消除不同机器时间的差异  导致的抢锁失败 在抢锁之前先随机睡眠一段时间
-		time.Sleep(time.Millisecond * time.Duration(rand.Intn(1000)))
+		// leader分配的任务只有本节点执行 不需要等待
+		if info.Trigger.Worker == "" {
+			time.Sleep(time.Millisecond * time.Duration(rand.Intn(1000)))
+		}
 
 		// 首先获取锁
-		// 初始化锁
+		// 初始化锁  允许并发执行的任务每次调度使用单独的锁
 		start := time.Now()
 		jobLock := common.CreateJobLock(info.Job.Name)
+		if info.Job.ConcurrencyPolicy == common.CONCURRENCY_ALLOW {
+			jobLock = common.CreateJobSlotLock(info.Job.Name, info.Job.MaxConcurrency, info.Trigger.TickID())
+		}
 		err := jobLock.TryLockJob()
 		defer jobLock.UnLock()
 
+		// 抢到锁的worker负责这次调度 记录调度时间 leader据此判断是否错过了执行
+		if info.Trigger.Scheduled() && (err == nil || err == common.ERR_JOB_CONCURRENCY_LIMIT) {
+			common.SaveLastScheduleTime(info.Job.Name, info.Trigger.Time)
+			recordCollapsed(info)
+		}
+
 		// 获取锁失败
 		if err != nil {
-			exeRes.err = err
-			exeRes.startTime = start
-			exeRes.endTime = time.Now()
-		} else {
-			// 抢锁成功 执行任务
-			// 如果设置了超时时间 那么需要对任务的执行时间进行控制
-			//timer := time.After(time.Duration(info.Job.Timeout) * time.Second)
-			timer := time.AfterFunc(time.Duration(info.Job.Timeout)*time.Second,
-				func() {
-					fmt.Println("任务", info.Job.Name, " 执行超时 : ", time.Now())
-					info.CancelFunc()
-					ip, _ := common.GetLocalIP()
-					alerts := &common.AlertsInfo{}
-					alerts.Worker = ip
-					alerts.AlertType = 1
-					alerts.ErrorInfo = "任务执行超时"
-					alerts.Time = time.Now().Format(common.TIME_FORMAT)
-					// 发送这个告警消息
-					body, _ := json.Marshal(alerts)
-					common.Send(body)
+			Schedule.pushJobExeRes(&JobExeResult{
+				exeInfo:   info,
+				startTime: start,
+				endTime:   time.Now(),
+				err:       err,
+				attempt:   1,
+				final:     true,
+
+				lockFailed: err != common.ERR_LOCK_ALREADY_REQUIRED && err != common.ERR_JOB_CONCURRENCY_LIMIT,
+				exitCode:   -1,
+			})
+			return
+		}
+
+		// 执行期间租约丢失 锁可能已经被其他worker抢到  按任务的策略杀死任务或者只做标记
+		ctx, cancelFunc := context.WithCancel(info.Ctx)
+		defer cancelFunc()
+		go func() {
+			select {
+			case <-jobLock.Lost():
+				fmt.Println("任务", info.Job.Name, " 执行期间任务锁丢失")
+				if info.Job.LockLostPolicy == common.LOCK_LOST_KILL {
+					cancelFunc()
+				}
+			case <-ctx.Done():
+			}
+		}()
+
+		// 获取任务需要的信号量  等待超时的这次执行记为跳过 其他错误不是任务本身失败 不告警
+		if len(info.Job.Semaphores) > 0 {
+			maxWait := time.Duration(info.Job.SemaphoreWait) * time.Second
+			if maxWait <= 0 {
+				maxWait = common.SEMAPHORE_MAX_WAIT * time.Second
+			}
+			holder := &common.SemaphoreHolder{
+				JobName:  info.Job.Name,
+				Worker:   WorkerNode.IP,
+				PlanTime: info.PlanTime.UnixNano() / 1000000,
+			}
+			if err := jobLock.AcquireSemaphores(ctx, info.Job.Semaphores, maxWait, holder); err != nil {
+				Schedule.pushJobExeRes(&JobExeResult{
+					exeInfo:   info,
+					startTime: start,
+					endTime:   time.Now(),
+					err:       err,
+					attempt:   1,
+					final:     true,
+
+					lockFailed: err != common.ERR_SEMAPHORE_TIMEOUT && err != common.ERR_SEMAPHORE_NOT_FOUND,
+					exitCode:   -1,
 				})
+				return
+			}
+		}
+
+		// 抢锁成功 执行任务  执行失败时在同一把锁下按重试策略重新执行
+		retry := info.Job.Retry
+		attempts := retry.Attempts()
+		for attempt := int64(1); attempt <= attempts; attempt++ {
+			exeRes := e.runCommand(ctx, info, attempt, jobLock.Revision())
+
+			// 锁丢失后不再重试
+			select {
+			case <-jobLock.Lost():
+				exeRes.lockLost = true
+			default:
+			}
+
+			// 执行成功 任务被杀死 锁丢失 重试次数用完 或者退出码不需要重试 都不再继续执行
+			exeRes.final = exeRes.err == nil || ctx.Err() != nil || exeRes.lockLost ||
+				attempt == attempts || !retry.ShouldRetry(exeRes.exitCode)
+
+			// 每次执行的结果都推给scheduler 记录日志
+			Schedule.pushJobExeRes(exeRes)
+			if exeRes.final {
+				return
+			}
 
-			cmd := exec.CommandContext(info.Ctx, "/bin/bash", "-c", info.Job.Command)
-			// 执行命令 并捕获错误
-			res, err := cmd.CombinedOutput()
-			timer.Stop()
-			exeRes.outPut = res
-			exeRes.err = err
-			exeRes.startTime = start
-			exeRes.endTime = time.Now()
-			fmt.Println(info.Job.Name, " 执行结果 : ", string(exeRes.outPut))
+			// 等待一段时间后重试  等待期间任务被杀死则直接退出
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retry.Delay(attempt)):
+			}
 		}
+	}()
+}
+
+// 执行一次任务命令  fencingToken通过环境变量传给任务
+func (e *Executor) runCommand(parent context.Context, info *JobExecuteInfo, attempt, fencingToken int64) *JobExeResult {
+	exeRes := &JobExeResult{exeInfo: info, attempt: attempt, startTime: time.Now(), exitCode: -1}
+
+	// 如果设置了超时时间 那么需要对任务的执行时间进行控制
+	var ctx context.Context
+	var cancelFunc context.CancelFunc
+	if info.Job.Timeout > 0 {
+		ctx, cancelFunc = context.WithTimeout(parent, time.Duration(info.Job.Timeout)*time.Second)
+	} else {
+		ctx, cancelFunc = context.WithCancel(parent)
+	}
+	defer cancelFunc()
+
+	// 执行时间超过任务配置的阈值时告警 任务继续执行
+	if policy := info.Job.Alert; policy != nil && policy.LongRunning > 0 {
+		longRunning := time.AfterFunc(time.Duration(policy.LongRunning)*time.Second, func() {
+			common.SendAlert(common.NewJobAlert(info.Job.Name, info.Job.Labels, policy, common.ALERT_TYPE_LONGRUNNING,
+				fmt.Sprintf("任务第%d次执行已经超过%d秒", attempt, policy.LongRunning)))
+		})
+		defer longRunning.Stop()
+	}
+
+	cmd := exec.CommandContext(ctx, "/bin/bash", "-c", info.Job.Command)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", common.JOB_FENCING_ENV, fencingToken))
+	// 执行命令 按行收集stdout和stderr 执行期间就可以在master查看输出
+	output := NewOutputStream(info, attempt)
+	exeRes.err = startCommand(cmd, output)
+	exeRes.outPut = output.Close()
+	exeRes.endTime = time.Now()
+
+	// 记录进程的退出状态和资源使用情况
+	if state := cmd.ProcessState; state != nil {
+		exeRes.exitCode = state.ExitCode()
+		exeRes.signal = exitSignal(state)
+		exeRes.userTime = state.UserTime()
+		exeRes.sysTime = state.SystemTime()
+		exeRes.maxRSS = maxRSS(state)
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		exeRes.timeout = true
+		fmt.Println("任务", info.Job.Name, " 第", attempt, "次执行超时 : ", time.Now())
+	}
+	fmt.Println(info.Job.Name, " 第", attempt, "次执行结果 : ", string(exeRes.outPut))
+
+	return exeRes
+}
+
+// 启动命令并读取输出 直到命令结束
+func startCommand(cmd *exec.Cmd, output *OutputStream) error {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
 
-		// 任务执行结束后 把该条记录推给scheduler  并从执行表里删除这条记录
-		Schedule.pushJobExeRes(exeRes)
+	// 必须读完所有输出之后才能调用Wait
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		output.Read(common.OUTPUT_STDOUT, stdout)
+	}()
+	go func() {
+		defer wg.Done()
+		output.Read(common.OUTPUT_STDERR, stderr)
 	}()
+	wg.Wait()
+
+	return cmd.Wait()
+}
+
+// 夏令时开始时被合并到本次调度的执行时间 记录为跳过
+func recordCollapsed(info *JobExecuteInfo) {
+	if info.Trigger.Type != common.JOB_TRIGGER_CRON {
+		return
+	}
+	schedule, err := common.ParseCron(info.Job.CronExpr, info.Job.Timezone)
+	if err != nil {
+		return
+	}
+
+	now := time.Now().UnixNano() / 1000000
+	for _, wall := range schedule.Collapsed(info.PlanTime) {
+		common.Sink.Append(&common.JobLog{
+			JobName:      info.Job.Name,
+			Command:      info.Job.Command,
+			Error:        fmt.Sprintf("夏令时切换跳过了本地时间 %s 合并到本次调度执行", wall.Format(common.TIME_FORMAT)),
+			PlanTime:     info.Trigger.Time,
+			ScheduleTime: now,
+			StartTime:    now,
+			EndTime:      now,
+			Reason:       common.JOB_REASON_SKIPPED,
+			Trigger:      info.Trigger.Type,
+			ExitCode:     -1,
+			WorkerIP:     WorkerNode.IP,
+			Hostname:     WorkerNode.Hostname,
+		})
+	}
 }
@@ -3,16 +3,28 @@ package worker
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/mvcc/mvccpb"
 	"scheduler/common"
 )
 
 type Job struct {
-	Name     string `json:"name"`      // 任务名
-	Command  string `json:"command"`   // shell命令
-	CronExpr string `json:"cron_expr"` //cron表达式
-	Timeout  int64  `json:"timeout"`   // 任务执行的超时时间 秒
+	Name              string              `json:"name"`               // 任务名
+	Command           string              `json:"command"`            // shell命令
+	CronExpr          string              `json:"cron_expr"`          //cron表达式
+	Timezone          string              `json:"timezone"`           // cron表达式使用的时区 IANA名称 如Asia/Shanghai 为空表示worker本地时区
+	Timeout           int64               `json:"timeout"`            // 任务执行的超时时间 秒
+	Retry             *common.RetryPolicy `json:"retry"`              // 任务失败后的重试策略
+	ConcurrencyPolicy string              `json:"concurrency_policy"` // 并发策略 Forbid(默认) / Allow / Replace
+	MaxConcurrency    int64               `json:"max_concurrency"`    // Allow策略下最多同时执行的实例数 0表示不限制
+	LockLostPolicy    string              `json:"lock_lost_policy"`   // 执行期间任务锁丢失的处理 mark(默认) / kill
+	Semaphores        []string            `json:"semaphores"`         // 执行前需要获取的信号量
+	SemaphoreWait     int64               `json:"semaphore_wait"`     // 等待信号量的最长时间 秒
+	Selector          map[string]string   `json:"selector"`           // 只在标签匹配的worker上执行 为空表示所有worker
+	Labels            map[string]string   `json:"labels"`             // 任务标签 用于告警路由
+	Alert             *common.AlertPolicy `json:"alert"`              // 任务的告警配置
+	Paused            bool                `json:"paused"`             // 任务是否被暂停 暂停的任务不会被调度
 }
 
 type EtcdManager struct {
@@ -24,6 +36,7 @@ type EtcdManager struct {
 type JobEvent struct {
 	eventType int64
 	job       *Job
+	trigger   *common.JobTrigger // 手动触发任务时的触发信息
 }
 
 var WorkEtcdManager *EtcdManager
@@ -40,6 +53,12 @@ func InitWorkJobManager() error {
 	WorkEtcdManager.watchJobs()
 	WorkEtcdManager.watchKiller()
 
+	// 由leader分配任务时 只执行分配给自己的任务
+	if common.IsDispatchMode() {
+		return WorkEtcdManager.watchAssign()
+	}
+	WorkEtcdManager.watchRunner()
+
 	return nil
 }
 
@@ -52,8 +71,8 @@ func (w *EtcdManager) watchJobs() error {
 	}
 
 	// 得到当前的所有任务
-	job := &Job{}
 	for _, v := range getResp.Kvs {
+		job := &Job{}
 		if err := json.Unmarshal(v.Value, job); err != nil {
 			continue
 		}
@@ -87,7 +106,7 @@ func (w *EtcdManager) watchJobs() error {
 					jobEvent = buildJobEvent(common.JOB_EVENT_SAVE, job)
 				case mvccpb.DELETE:
 					// 任务被删除了
-					job := &Job{Name: common.ExtractName(string(event.Kv.Key), common.JOB_DELETE_DIR)}
+					job := &Job{Name: common.ExtractName(string(event.Kv.Key), common.JOB_SAVE_DIR)}
 					jobEvent = buildJobEvent(common.JOB_EVENT_DELETE, job)
 				}
 
@@ -123,6 +142,85 @@ func (w *EtcdManager) watchKiller() {
 	}()
 }
 
+// 监听手动触发任务事件
+func (w *EtcdManager) watchRunner() {
+	//监听 JOB_RUN_DIR目录的变化
+	go func() {
+		watchChan := w.Watcher.Watch(context.TODO(), common.JOB_RUN_DIR, clientv3.WithPrefix())
+
+		for watchResp := range watchChan {
+			for _, event := range watchResp.Events {
+				switch event.Type {
+				case mvccpb.PUT:
+					// 有任务被手动触发
+					trigger := &common.JobTrigger{}
+					if err := json.Unmarshal(event.Kv.Value, trigger); err != nil {
+						continue
+					}
+					jobEvent := buildJobEvent(common.JOB_EVENT_RUN, &Job{Name: trigger.Name})
+					jobEvent.trigger = trigger
+					// 将这个任务退给调度器
+					Schedule.pushJobEvent(jobEvent)
+				case mvccpb.DELETE:
+					// 触发记录自动过期 被删除
+				}
+			}
+		}
+	}()
+}
+
+// 监听leader分配给本节点的任务
+func (w *EtcdManager) watchAssign() error {
+	ip, err := common.GetLocalIP()
+	if err != nil {
+		return err
+	}
+
+	//监听 JOB_ASSIGN_DIR/ip/ 目录的变化
+	go func() {
+		assignDir := fmt.Sprintf("%s%s/", common.JOB_ASSIGN_DIR, ip)
+		watchChan := w.Watcher.Watch(context.TODO(), assignDir, clientv3.WithPrefix())
+
+		for watchResp := range watchChan {
+			for _, event := range watchResp.Events {
+				switch event.Type {
+				case mvccpb.PUT:
+					// 有新的任务分配给本节点
+					trigger := &common.JobTrigger{}
+					if err := json.Unmarshal(event.Kv.Value, trigger); err != nil {
+						continue
+					}
+					jobEvent := buildJobEvent(common.JOB_EVENT_ASSIGN, &Job{Name: trigger.Name})
+					jobEvent.trigger = trigger
+					// 将这个任务退给调度器
+					Schedule.pushJobEvent(jobEvent)
+				case mvccpb.DELETE:
+					// 任务执行完成 或者分配记录过期
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// 任务执行完成或者被跳过后 删除leader的分配记录
+func releaseAssign(trigger *common.JobTrigger) {
+	if trigger.Worker == "" {
+		return
+	}
+	common.ETCD.KV.Delete(context.TODO(), common.JobAssignKey(trigger))
+}
+
+// 由工作流触发的任务结束后 上报任务的结束原因 由leader推进工作流
+func reportWorkflow(trigger *common.JobTrigger, reason string) {
+	if trigger.WorkflowRunID == "" {
+		return
+	}
+	doneKey := fmt.Sprintf("%s%s/%s", common.WORKFLOW_DONE_DIR, trigger.WorkflowRunID, trigger.Name)
+	common.ETCD.KV.Put(context.TODO(), doneKey, reason)
+}
+
 func buildJobEvent(eventType int64, job *Job) *JobEvent {
 	return &JobEvent{
 		eventType: eventType,
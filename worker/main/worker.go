@@ -16,14 +16,18 @@ func initEnv() {
 var etcdConfig = flag.String("e", "conf/etcd.toml", "etcd配置文件路径")
 var mongoConfig = flag.String("m", "conf/mongo.toml", "mongo配置文件路径")
 var mqConfig = flag.String("mq", "conf/mq.toml", "mq配置文件路径")
+var dispatchConfig = flag.String("d", "conf/dispatch.toml", "任务分配配置文件路径")
+var workerConfig = flag.String("w", "conf/worker.toml", "worker节点配置文件路径")
+var logConfig = flag.String("l", "conf/log.toml", "日志存储配置文件路径")
 
 func main() {
 	flag.Parse()
 
 	initEnv()
 
-	// 初始化mq
-	if err := common.InitMqCfg(*mqConfig); err != nil {
+	// 初始化事件总线
+	if err := common.InitMqCfg(*mqConfig, "worker"); err != nil {
+		fmt.Println("初始化事件总线出错 : ", err)
 		return
 	}
 
@@ -33,19 +37,19 @@ func main() {
 		return
 	}
 
-	if err := common.InitLock(); err !=nil {
-		fmt.Println("Init lock 报错 : ", err)
+	// 初始化任务分配方式
+	if err := common.InitDispatchCfg(*dispatchConfig); err != nil {
+		fmt.Println("初始化加载任务分配配置出错 : ", err)
 		return
-
 	}
 
-	// 初始化MongoDB
-	if err := common.InitLogSink(*mongoConfig); err != nil {
-		fmt.Println("初始化加载MongoDB配置出错")
+	// 初始化日志存储
+	if err := common.InitLogSink(*logConfig, *mongoConfig, "worker"); err != nil {
+		fmt.Println("初始化日志存储出错 : ", err)
 	}
 
 	// 初始化 worker节点注册到etcd
-	err := worker.InitRegister()
+	err := worker.InitRegister(*workerConfig)
 	if err != nil {
 		return
 	}
@@ -63,5 +67,12 @@ func main() {
 
 	for {
 		time.Sleep(10 * time.Second)
+
+		// 有日志缓冲或者丢弃时输出日志写入的统计
+		if common.Sink != nil {
+			if stats := common.Sink.Stats(); stats.Buffered > 0 || stats.Dropped > 0 {
+				fmt.Printf("日志写入统计 缓冲 : %d 丢弃 : %d 已写入 : %d\n", stats.Buffered, stats.Dropped, stats.Written)
+			}
+		}
 	}
 }
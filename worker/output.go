@@ -0,0 +1,154 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/coreos/etcd/clientv3"
+	"io"
+	"scheduler/common"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 收集任务执行中的输出  按行定期发布到etcd 供master实时查看
+// 每次只发布上次发布之后的新输出 避免重复的内容占满etcd的历史版本
+type OutputStream struct {
+	mutex    sync.Mutex
+	key      string
+	output   *common.JobOutput
+	combined bytes.Buffer // 完整的输出 任务结束后写入日志
+	dirty    bool         // 是否有还没有发布的输出
+
+	leaseId   clientv3.LeaseID
+	stopLease context.CancelFunc
+	done      chan struct{} // 通知发布协程退出
+	stopped   chan struct{} // 发布协程已经退出
+}
+
+// 创建一次执行的输出流 并开始定期发布
+func NewOutputStream(info *JobExecuteInfo, attempt int64) *OutputStream {
+	planTime := info.PlanTime.UnixNano() / 1000000
+	o := &OutputStream{
+		key: common.JobOutputKey(info.Job.Name, planTime, attempt),
+		output: &common.JobOutput{
+			Name:     info.Job.Name,
+			PlanTime: planTime,
+			Attempt:  attempt,
+		},
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if WorkerNode != nil {
+		o.output.Worker = WorkerNode.IP
+	}
+
+	// 执行期间自动续租 结束后停止续租 输出在TTL之后自动删除
+	ctx, cancelFunc := context.WithCancel(context.TODO())
+	o.stopLease = cancelFunc
+	if leaseGrant, err := common.ETCD.Lease.Grant(ctx, common.JOB_OUTPUT_TTL); err == nil {
+		if keepChan, err := common.ETCD.Lease.KeepAlive(ctx, leaseGrant.ID); err == nil {
+			o.leaseId = leaseGrant.ID
+			go func() {
+				for range keepChan {
+				}
+			}()
+		}
+	}
+
+	go o.publishLoop()
+	return o
+}
+
+// 按行读取stdout或stderr  直到管道关闭
+func (o *OutputStream) Read(stream string, r io.Reader) {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			o.write(stream, line)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (o *OutputStream) write(stream, line string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.combined.WriteString(line)
+
+	o.output.Seq++
+	o.output.Lines = append(o.output.Lines, &common.OutputLine{
+		Seq:    o.output.Seq,
+		Stream: stream,
+		Text:   strings.TrimRight(line, "\r\n"),
+		Time:   time.Now().UnixNano() / 1000000,
+	})
+	// 发布不及时的时候只保留最近的若干行
+	if n := len(o.output.Lines); n > common.OUTPUT_BUFFER_LINES {
+		o.output.Lines = o.output.Lines[n-common.OUTPUT_BUFFER_LINES:]
+	}
+	o.dirty = true
+}
+
+// 定期把新的输出发布到etcd  没有新的输出时不写入
+func (o *OutputStream) publishLoop() {
+	ticker := time.NewTicker(common.OUTPUT_FLUSH_INTERVAL * time.Millisecond)
+	defer ticker.Stop()
+	defer close(o.stopped)
+
+	for {
+		select {
+		case <-ticker.C:
+			o.publish()
+		case <-o.done:
+			return
+		}
+	}
+}
+
+func (o *OutputStream) publish() {
+	o.mutex.Lock()
+	if !o.dirty {
+		o.mutex.Unlock()
+		return
+	}
+	value, err := json.Marshal(o.output)
+	o.output.Lines = nil
+	o.dirty = false
+	o.mutex.Unlock()
+	if err != nil {
+		return
+	}
+
+	var opts []clientv3.OpOption
+	if o.leaseId != 0 {
+		opts = append(opts, clientv3.WithLease(o.leaseId))
+	}
+	if _, err := common.ETCD.KV.Put(context.TODO(), o.key, string(value), opts...); err != nil {
+		fmt.Println("任务", o.output.Name, " 发布输出出错 : ", err)
+	}
+}
+
+// 任务执行结束 发布剩余的输出并返回完整的输出
+func (o *OutputStream) Close() []byte {
+	// 等待正在进行的发布完成 保证结束标记是最后写入的
+	close(o.done)
+	<-o.stopped
+
+	o.mutex.Lock()
+	o.output.Done = true
+	o.dirty = true
+	o.mutex.Unlock()
+
+	o.publish()
+	o.stopLease()
+
+	return o.combined.Bytes()
+}
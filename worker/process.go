@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package worker
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// 返回终止进程的信号  正常退出时返回空
+func exitSignal(state *os.ProcessState) string {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return status.Signal().String()
+	}
+	return ""
+}
+
+// 返回进程的最大常驻内存 KB
+func maxRSS(state *os.ProcessState) int64 {
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	// macOS上的单位是字节 linux上是KB
+	if runtime.GOOS == "darwin" {
+		return int64(rusage.Maxrss) / 1024
+	}
+	return int64(rusage.Maxrss)
+}
@@ -0,0 +1,13 @@
+package worker
+
+import "os"
+
+// windows上没有信号
+func exitSignal(state *os.ProcessState) string {
+	return ""
+}
+
+// windows上不统计最大常驻内存
+func maxRSS(state *os.ProcessState) int64 {
+	return 0
+}
@@ -2,28 +2,37 @@ package worker
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/coreos/etcd/clientv3"
 	"scheduler/common"
 	"time"
 )
 
+// 本节点的信息
+var WorkerNode *common.WorkerInfo
+
 // 初始化worker注册到etcd
-func InitRegister() error {
-	ip, err := common.GetLocalIP()
+func InitRegister(path string) error {
+	info, err := common.LoadWorkerInfo(path)
 	if err != nil {
 		return err
 	}
+	WorkerNode = info
 
-	registerKey := fmt.Sprintf("%s%s", common.JOB_WORKER_DIR, ip)
+	registerKey := fmt.Sprintf("%s%s", common.JOB_WORKER_DIR, info.IP)
+	registerValue, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
 
-	go keepOnline(registerKey)
+	go keepOnline(registerKey, string(registerValue))
 
 	return nil
 }
 
-// 自动注册到etcd的 /cron/worker1/ip目录下  并自动续租
-func keepOnline(registerKey string) {
+// 自动注册到etcd的 /cron/workers/ip目录下  并自动续租
+func keepOnline(registerKey, registerValue string) {
 	for {
 		//创建租约
 		leaseGrant, err := common.ETCD.Lease.Grant(context.TODO(), 10)
@@ -39,7 +48,7 @@ func keepOnline(registerKey string) {
 
 		// 注册到etcd
 		ctx, cancelFunc := context.WithCancel(context.TODO())
-		_, err = common.ETCD.KV.Put(ctx, registerKey, "", clientv3.WithLease(leaseGrant.ID))
+		_, err = common.ETCD.KV.Put(ctx, registerKey, registerValue, clientv3.WithLease(leaseGrant.ID))
 		if err != nil {
 			cancelFunc()
 			time.Sleep(time.Second)
@@ -2,25 +2,23 @@ package worker
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"github.com/gorhill/cronexpr"
 	"scheduler/common"
 	"time"
 )
 
 // 任务调度
 type Scheduler struct {
-	JobEventChan    chan *JobEvent              // etcd的任务事件chan
-	JobPlanMap      map[string]*JobSchedulePlan // 任务调度计划列表
-	JobExecutingMap map[string]*JobExecuteInfo  // 正在执行的任务列表
-	JobExeResChan   chan *JobExeResult          // 任务的执行结果
+	JobEventChan    chan *JobEvent               // etcd的任务事件chan
+	JobPlanMap      map[string]*JobSchedulePlan  // 任务调度计划列表
+	JobExecutingMap map[string][]*JobExecuteInfo // 正在执行的任务列表 Allow策略下同一个任务可能有多个实例
+	JobExeResChan   chan *JobExeResult           // 任务的执行结果
 }
 
 // 任务调度计划
 type JobSchedulePlan struct {
 	Job      *Job                 //任务信息
-	CronExpr *cronexpr.Expression // 解析好的cron表达式
+	CronExpr *common.CronSchedule // 解析好的cron表达式 带有时区
 	NextTime time.Time            //任务下次的执行时间
 }
 
@@ -31,6 +29,11 @@ type JobExecuteInfo struct {
 	RealTime   time.Time          // 任务实际执行时间
 	Ctx        context.Context    // 用于取消任务的上下文信息
 	CancelFunc context.CancelFunc // 用于取消任务的cancel func
+	Done       chan struct{}      // 任务执行结束并释放锁后关闭
+	Trigger    *common.JobTrigger // 任务的触发信息 定时调度或者手动触发
+
+	cancelReason string            // 任务被取消的原因 killed / replaced
+	waitFor      []*JobExecuteInfo // Replace策略下需要等待结束的旧实例
 }
 
 var Schedule *Scheduler
@@ -39,7 +42,7 @@ func InitScheduler() {
 	Schedule = &Scheduler{
 		JobEventChan:    make(chan *JobEvent, 1000),
 		JobPlanMap:      make(map[string]*JobSchedulePlan),
-		JobExecutingMap: make(map[string]*JobExecuteInfo),
+		JobExecutingMap: make(map[string][]*JobExecuteInfo),
 		JobExeResChan:   make(chan *JobExeResult, 1000),
 	}
 
@@ -81,8 +84,8 @@ func (s *Scheduler) trySchedule() time.Duration {
 	now := time.Now()
 	var nearTime *time.Time
 
-	//如果当前还没有任务
-	if len(s.JobPlanMap) == 0 {
+	//如果当前还没有任务  或者由leader分配任务
+	if len(s.JobPlanMap) == 0 || common.IsDispatchMode() {
 		return time.Second
 	}
 
@@ -91,7 +94,11 @@ func (s *Scheduler) trySchedule() time.Duration {
 		// 如果当前有过期的任务 则立即执行
 		if plan.NextTime.Before(now) || plan.NextTime.Equal(now) {
 			// 构建任务执行状态信息
-			s.tryStartJob(plan)
+			s.tryStartJob(plan, &common.JobTrigger{
+				Name: plan.Job.Name,
+				Type: common.JOB_TRIGGER_CRON,
+				Time: plan.NextTime.UnixNano() / 1000000,
+			})
 			// 在计算这个任务的下次执行时间
 			plan.NextTime = plan.CronExpr.Next(now)
 		}
@@ -114,13 +121,18 @@ func (s *Scheduler) pushJobEvent(event *JobEvent) {
 func (s *Scheduler) handleJobEvent(event *JobEvent) {
 	switch event.eventType {
 	case common.JOB_EVENT_SAVE: // 任务保存事件
-	    // 如果修改了一个正在执行的任务  那么就先把这个任务停止
-		if exe, exist := s.JobExecutingMap[event.job.Name]; exist {
-			exe.CancelFunc()
-			delete(s.JobExecutingMap, event.job.Name)
+		// Replace策略下修改任务会先停止正在执行的实例  其他策略下正在执行的实例继续执行完
+		if event.job.ConcurrencyPolicy == common.CONCURRENCY_REPLACE {
+			s.cancelExecuting(event.job.Name, common.JOB_REASON_REPLACED)
+		}
+
+		// 暂停的任务 以及标签不匹配本节点的任务不参与调度  正在执行的实例继续执行完
+		if event.job.Paused || !WorkerNode.Match(event.job.Selector) {
+			delete(s.JobPlanMap, event.job.Name)
+			return
 		}
 
-		// 构造一个任务事件 
+		// 构造一个任务事件
 		plan, err := s.buildSchedulePlan(event.job)
 		if err != nil {
 			return
@@ -132,34 +144,59 @@ func (s *Scheduler) handleJobEvent(event *JobEvent) {
 		if _, exist := s.JobPlanMap[event.job.Name]; exist {
 			delete(s.JobPlanMap, event.job.Name)
 		}
-		if exe, exist := s.JobExecutingMap[event.job.Name]; exist {
-			exe.CancelFunc()
-			delete(s.JobExecutingMap, event.job.Name)
-		}
+		s.cancelExecuting(event.job.Name, common.JOB_REASON_KILLED)
 	case common.JOB_EVENT_KILL: // 任务杀死事件
 		// 处理任务杀死事件
 		// 取消command执行  首先判断该任务是否在执行
-		if exe, exist := s.JobExecutingMap[event.job.Name]; exist {
-			// 触发command杀死shell子进程  任务退出
-			exe.CancelFunc()
-
-			ip, _ := common.GetLocalIP()
-			alerts := &common.AlertsInfo{}
-			alerts.Worker = ip
-			alerts.AlertType = 3
-			alerts.ErrorInfo = "任务被强制杀死"
-			alerts.Time = time.Now().Format(common.TIME_FORMAT)
+		// 触发command杀死shell子进程  任务退出
+		if killed := s.cancelExecuting(event.job.Name, common.JOB_REASON_KILLED); len(killed) > 0 {
 			// 发送这个告警消息
-			body, _ := json.Marshal(alerts)
-			common.Send(body)
+			job := killed[0].Job
+			common.SendAlert(common.NewJobAlert(job.Name, job.Labels, job.Alert, common.ALERT_TYPE_KILLED, "任务被强制杀死"))
+		}
+	case common.JOB_EVENT_RUN, common.JOB_EVENT_ASSIGN: // 任务手动触发 或者leader分配任务
+		// 只执行本节点已经加载的任务
+		if plan, exist := s.JobPlanMap[event.job.Name]; exist {
+			s.tryStartJob(plan, event.trigger)
+		} else if event.eventType == common.JOB_EVENT_ASSIGN {
+			// 分配给本节点的任务没有加载 上报跳过 避免工作流一直等待
+			fmt.Println("任务", event.job.Name, " 没有加载 跳过分配的任务")
+			releaseAssign(event.trigger)
+			reportWorkflow(event.trigger, common.JOB_REASON_SKIPPED)
+		}
+	}
+}
 
-			delete(s.JobExecutingMap, event.job.Name)
+// 取消任务所有正在执行的实例 并从执行表中删除  返回被取消的实例
+func (s *Scheduler) cancelExecuting(jobName, reason string) []*JobExecuteInfo {
+	executing := s.JobExecutingMap[jobName]
+	for _, exe := range executing {
+		exe.cancelReason = reason
+		exe.CancelFunc()
+	}
+	delete(s.JobExecutingMap, jobName)
+	return executing
+}
+
+// 从执行表中删除任务的一个实例
+func (s *Scheduler) removeExecuting(info *JobExecuteInfo) {
+	executing := s.JobExecutingMap[info.Job.Name]
+	for i, exe := range executing {
+		if exe == info {
+			executing = append(executing[:i], executing[i+1:]...)
+			break
 		}
 	}
+
+	if len(executing) == 0 {
+		delete(s.JobExecutingMap, info.Job.Name)
+	} else {
+		s.JobExecutingMap[info.Job.Name] = executing
+	}
 }
 
 func (s *Scheduler) buildSchedulePlan(job *Job) (*JobSchedulePlan, error) {
-	expr, err := cronexpr.Parse(job.CronExpr)
+	expr, err := common.ParseCron(job.CronExpr, job.Timezone)
 	if err != nil {
 		return nil, err
 	}
@@ -172,28 +209,74 @@ func (s *Scheduler) buildSchedulePlan(job *Job) (*JobSchedulePlan, error) {
 }
 
 // 尝试启动一个任务
-func (s *Scheduler) tryStartJob(plan *JobSchedulePlan) {
-	// 先查看这个任务是否在执行
-	if _, executing := s.JobExecutingMap[plan.Job.Name]; executing {
-		fmt.Println("job is executing...")
-		return
+func (s *Scheduler) tryStartJob(plan *JobSchedulePlan, trigger *common.JobTrigger) {
+	// 先查看这个任务是否在执行  根据任务的并发策略决定如何处理
+	var replaced []*JobExecuteInfo
+	if executing := s.JobExecutingMap[plan.Job.Name]; len(executing) > 0 {
+		switch plan.Job.ConcurrencyPolicy {
+		case common.CONCURRENCY_ALLOW:
+			// 允许并发执行 但本节点上的实例数已经达到上限
+			if plan.Job.MaxConcurrency > 0 && int64(len(executing)) >= plan.Job.MaxConcurrency {
+				s.skipJob(plan, trigger, common.ERR_JOB_CONCURRENCY_LIMIT.Error())
+				return
+			}
+		case common.CONCURRENCY_REPLACE:
+			// 取消正在执行的实例 重新开始执行
+			replaced = s.cancelExecuting(plan.Job.Name, common.JOB_REASON_REPLACED)
+		default:
+			// 默认不允许并发执行 跳过本次调度
+			s.skipJob(plan, trigger, "任务正在执行 跳过本次调度")
+			return
+		}
 	}
 
 	// 构建任务执行状态信息
-	exeInfo := s.buildJobExecuteInfo(plan)
+	exeInfo := s.buildJobExecuteInfo(plan, trigger)
+	exeInfo.waitFor = replaced
 	// 保存任务的执行状态 (正在执行)
-	s.JobExecutingMap[plan.Job.Name] = exeInfo
+	s.JobExecutingMap[plan.Job.Name] = append(s.JobExecutingMap[plan.Job.Name], exeInfo)
 
 	//执行任务
 	fmt.Println("执行任务 : ", exeInfo.Job.Name)
 	Exe.ExecuteJob(exeInfo)
 }
 
-func (s *Scheduler) buildJobExecuteInfo(plan *JobSchedulePlan) *JobExecuteInfo {
+// 记录一次被跳过的调度
+func (s *Scheduler) skipJob(plan *JobSchedulePlan, trigger *common.JobTrigger, reason string) {
+	fmt.Println("任务", plan.Job.Name, " 跳过本次调度 : ", reason)
+	releaseAssign(trigger)
+	reportWorkflow(trigger, common.JOB_REASON_SKIPPED)
+	if trigger.Scheduled() {
+		common.SaveLastScheduleTime(plan.Job.Name, trigger.Time)
+	}
+
+	now := time.Now().UnixNano() / 1000000
+	common.Sink.Append(&common.JobLog{
+		JobName:      plan.Job.Name,
+		Command:      plan.Job.Command,
+		Error:        reason,
+		PlanTime:     trigger.Time,
+		ScheduleTime: now,
+		StartTime:    now,
+		EndTime:      now,
+		Reason:       common.JOB_REASON_SKIPPED,
+		Trigger:      trigger.Type,
+		User:         trigger.User,
+		ExitCode:     -1,
+		WorkerIP:     WorkerNode.IP,
+		Hostname:     WorkerNode.Hostname,
+
+		WorkflowRunID: trigger.WorkflowRunID,
+	})
+}
+
+func (s *Scheduler) buildJobExecuteInfo(plan *JobSchedulePlan, trigger *common.JobTrigger) *JobExecuteInfo {
 	exeInfo := &JobExecuteInfo{
 		Job:      plan.Job,
-		PlanTime: plan.NextTime,
+		PlanTime: time.Unix(0, trigger.Time*int64(time.Millisecond)),
 		RealTime: time.Now(),
+		Done:     make(chan struct{}),
+		Trigger:  trigger,
 	}
 
 	exeInfo.Ctx, exeInfo.CancelFunc = context.WithCancel(context.TODO())
@@ -205,37 +288,94 @@ func (s *Scheduler) pushJobExeRes(res *JobExeResult) {
 }
 
 func (s *Scheduler) handleJonExeRes(res *JobExeResult) {
-	// 从任务执行表中删除这个任务
-	delete(s.JobExecutingMap, res.exeInfo.Job.Name)
-
-	if res.err != common.ERR_LOCK_ALREADY_REQUIRED {
-		// 生成日志 保存日志
-		log := &common.JobLog{
-			JobName:      res.exeInfo.Job.Name,
-			Command:      res.exeInfo.Job.Command,
-			OutPut:       string(res.outPut),
-			PlanTime:     res.exeInfo.PlanTime.UnixNano() / 1000000,
-			ScheduleTime: res.exeInfo.RealTime.UnixNano() / 1000000,
-			StartTime:    res.startTime.UnixNano() / 1000000,
-			EndTime:      res.endTime.UnixNano() / 1000000,
-		}
+	// 最后一次执行结束后 从任务执行表中删除这个任务
+	if res.final {
+		s.removeExecuting(res.exeInfo)
+		releaseAssign(res.exeInfo.Trigger)
+	}
+
+	// 没有抢到锁说明任务由其他worker执行
+	if res.err == common.ERR_LOCK_ALREADY_REQUIRED {
+		return
+	}
+
+	// 生成日志 保存日志
+	log := &common.JobLog{
+		JobName:      res.exeInfo.Job.Name,
+		Command:      res.exeInfo.Job.Command,
+		OutPut:       string(res.outPut),
+		PlanTime:     res.exeInfo.PlanTime.UnixNano() / 1000000,
+		ScheduleTime: res.exeInfo.RealTime.UnixNano() / 1000000,
+		StartTime:    res.startTime.UnixNano() / 1000000,
+		EndTime:      res.endTime.UnixNano() / 1000000,
+		Attempt:      res.attempt,
+		Trigger:      res.exeInfo.Trigger.Type,
+		User:         res.exeInfo.Trigger.User,
+		ExitCode:     res.exitCode,
+		Signal:       res.signal,
+		WorkerIP:     WorkerNode.IP,
+		Hostname:     WorkerNode.Hostname,
+		UserTime:     res.userTime.Nanoseconds() / 1000000,
+		SysTime:      res.sysTime.Nanoseconds() / 1000000,
+		MaxRSS:       res.maxRSS,
+
+		WorkflowRunID: res.exeInfo.Trigger.WorkflowRunID,
+	}
+
+	if res.err != nil {
+		log.Error = res.err.Error()
+	}
 
-		if res.err != nil {
-			log.Error = res.err.Error()
+	switch {
+	case res.exeInfo.cancelReason != "":
+		log.Reason = res.exeInfo.cancelReason
+	case res.err == common.ERR_JOB_CONCURRENCY_LIMIT || res.err == common.ERR_SEMAPHORE_TIMEOUT:
+		log.Reason = common.JOB_REASON_SKIPPED
+	case res.err == common.ERR_SEMAPHORE_NOT_FOUND:
+		log.Reason = common.JOB_REASON_SEMAPHORE
+	case res.lockFailed:
+		log.Reason = common.JOB_REASON_LOCKFAIL
+	case res.lockLost:
+		log.Reason = common.JOB_REASON_LOCKLOST
+		if log.Error == "" {
+			log.Error = "执行期间任务锁的租约丢失"
 		}
+	case res.timeout:
+		log.Reason = common.JOB_REASON_TIMEOUT
+	case res.err != nil:
+		log.Reason = common.JOB_REASON_FAILED
+	default:
+		log.Reason = common.JOB_REASON_SUCCESS
+	}
 
-		if res.err != nil && res.err != common.ERR_LOCK_ALREADY_REQUIRED {
-			ip, _ := common.GetLocalIP()
-			alerts := &common.AlertsInfo{}
-			alerts.Worker = ip
-			alerts.AlertType = 2
-			alerts.ErrorInfo = "任务执行失败"
-			alerts.Time = time.Now().Format(common.TIME_FORMAT)
-			// 发送这个告警消息
-			body, _ := json.Marshal(alerts)
-			common.Send(body)
+	// 重试次数用完后仍然失败才告警  被杀死 被替换 被跳过的任务不告警
+	if res.final && (log.Reason == common.JOB_REASON_FAILED || log.Reason == common.JOB_REASON_TIMEOUT) {
+		job := res.exeInfo.Job
+		alertType, errorInfo := int64(common.ALERT_TYPE_FAILED), "任务执行失败"
+		if res.timeout {
+			alertType, errorInfo = common.ALERT_TYPE_TIMEOUT, "任务执行超时"
 		}
+		// 发送这个告警消息
+		common.SendAlert(common.NewJobAlert(job.Name, job.Labels, job.Alert, alertType, errorInfo))
+	}
+
+	// 之前失败的任务再次成功 发送恢复通知  查询etcd不阻塞调度协程
+	if res.final && log.Reason == common.JOB_REASON_SUCCESS {
+		go notifyRecovered(res.exeInfo.Job)
+	}
 
-		common.Sink.Append(log)
+	if res.final {
+		reportWorkflow(res.exeInfo.Trigger, log.Reason)
+	}
+
+	common.Sink.Append(log)
+}
+
+// 任务处于失败状态时发送恢复通知
+func notifyRecovered(job *Job) {
+	failing, err := common.JobFailing(job.Name)
+	if err != nil || !failing {
+		return
 	}
+	common.SendAlert(common.NewJobAlert(job.Name, job.Labels, job.Alert, common.ALERT_TYPE_RECOVERED, "任务恢复执行成功"))
 }